@@ -0,0 +1,163 @@
+package geerpc
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+/* ****************************************************
+管理接口：查看服务端的连接以及正在处理的请求
+GET    列出所有连接和每个连接上正在处理的请求
+DELETE ?conn=ID         关闭指定连接
+DELETE ?conn=ID&req=ID  取消指定连接上的某个请求 请求ID由服务端分配 见GET的结果
+可以关闭连接和取消请求 因此不随HandleHTTP注册 需要调用HandleAdmin并提供认证函数
+**************************************************** */
+
+const defaultAdminPath = "/debug/geerpc/admin"
+
+type adminHTTP struct {
+	*Server
+	auth func(req *http.Request) bool
+}
+
+// 返回管理接口的http.Handler auth返回false的请求得到403 auth为nil时拒绝所有请求
+func (server *Server) AdminHandler(auth func(req *http.Request) bool) http.Handler {
+	return adminHTTP{Server: server, auth: auth}
+}
+
+// 在http.DefaultServeMux的path上注册管理接口 path为空时使用/debug/geerpc/admin
+func (server *Server) HandleAdmin(path string, auth func(req *http.Request) bool) {
+	if path == "" {
+		path = defaultAdminPath
+	}
+	http.Handle(path, server.AdminHandler(auth))
+	server.logger.Printf("rpc server admin path: %s", path)
+}
+
+func HandleAdmin(path string, auth func(req *http.Request) bool) {
+	DefaultServer.HandleAdmin(path, auth)
+}
+
+type adminConnection struct {
+	ID          uint64         `json:"id"`
+	RemoteAddr  string         `json:"remote_addr"`
+	CodecType   string         `json:"codec"`
+	Since       string         `json:"since"`
+	Age         string         `json:"age"`
+	NumRequests uint64         `json:"requests"`
+	InFlight    []adminRequest `json:"in_flight"`
+}
+
+type adminRequest struct {
+	ID            uint64 `json:"id"`  // 服务端分配的请求ID 用于取消请求
+	Seq           uint64 `json:"seq"` // 客户端指定的序号 可能重复
+	ServiceMethod string `json:"method"`
+	Age           string `json:"age"`
+}
+
+func (server adminHTTP) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if server.auth == nil || !server.auth(req) {
+		http.Error(w, "rpc admin: forbidden", http.StatusForbidden)
+		return
+	}
+	switch req.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(server.connections()); err != nil {
+			server.logger.Printf("rpc admin: error encoding connections: %v", err)
+		}
+	case "DELETE":
+		id, err := strconv.ParseUint(req.URL.Query().Get("conn"), 10, 64)
+		if err != nil {
+			http.Error(w, "rpc admin: invalid conn id", http.StatusBadRequest)
+			return
+		}
+		if reqID := req.URL.Query().Get("req"); reqID != "" {
+			n, err := strconv.ParseUint(reqID, 10, 64)
+			if err != nil {
+				http.Error(w, "rpc admin: invalid request id", http.StatusBadRequest)
+				return
+			}
+			if !server.CancelRequest(id, n) {
+				http.Error(w, "rpc admin: request not found", http.StatusNotFound)
+			}
+			return
+		}
+		if !server.CloseConn(id) {
+			http.Error(w, "rpc admin: connection not found", http.StatusNotFound)
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (server adminHTTP) connections() []adminConnection {
+	server.mu.Lock()
+	conns := make([]*serverConn, 0, len(server.conns))
+	for _, conn := range server.conns {
+		conns = append(conns, conn)
+	}
+	server.mu.Unlock()
+	sort.Slice(conns, func(i, j int) bool { return conns[i].id < conns[j].id })
+
+	now := time.Now()
+	result := make([]adminConnection, 0, len(conns))
+	for _, conn := range conns {
+		ac := adminConnection{
+			ID:          conn.id,
+			RemoteAddr:  conn.remoteAddr,
+			CodecType:   string(conn.opt.CodecType),
+			Since:       conn.start.Format(time.RFC3339),
+			Age:         now.Sub(conn.start).String(),
+			NumRequests: atomic.LoadUint64(&conn.numRequests),
+			InFlight:    make([]adminRequest, 0),
+		}
+		conn.mu.Lock()
+		for _, req := range conn.requests {
+			ac.InFlight = append(ac.InFlight, adminRequest{
+				ID:            req.id,
+				Seq:           req.h.Seq,
+				ServiceMethod: req.h.ServiceMethod,
+				Age:           now.Sub(req.start).String(),
+			})
+		}
+		conn.mu.Unlock()
+		sort.Slice(ac.InFlight, func(i, j int) bool { return ac.InFlight[i].ID < ac.InFlight[j].ID })
+		result = append(result, ac)
+	}
+	return result
+}
+
+// 关闭指定ID的连接 连接上正在处理的请求将无法返回响应
+func (server *Server) CloseConn(id uint64) bool {
+	server.mu.Lock()
+	conn := server.conns[id]
+	server.mu.Unlock()
+	if conn == nil {
+		return false
+	}
+	_ = conn.ReadWriteCloser.Close()
+	return true
+}
+
+// 取消指定连接上正在处理的请求 reqID为服务端分配的请求ID
+func (server *Server) CancelRequest(connID, reqID uint64) bool {
+	server.mu.Lock()
+	conn := server.conns[connID]
+	server.mu.Unlock()
+	if conn == nil {
+		return false
+	}
+	conn.mu.Lock()
+	req := conn.requests[reqID]
+	conn.mu.Unlock()
+	if req == nil {
+		return false
+	}
+	req.Cancel()
+	return true
+}
@@ -0,0 +1,77 @@
+package geerpc
+
+import (
+	"encoding/json"
+	"fmt"
+	"geerpc/codec"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdminHTTP_CancelRequest(t *testing.T) {
+	var b Bar
+	server := NewServer()
+	server.SetLogger(nil)
+	_ = server.Register(b)
+	l, _ := net.Listen("tcp", ":0")
+	defer l.Close()
+	go server.Accept(l)
+
+	client, err := Dial("tcp", l.Addr().String())
+	_assert(err == nil, "dial error: %v", err)
+	defer client.Close()
+	var reply int
+	call := client.Go("Bar.Timeout", 1, &reply, nil)
+
+	admin := server.AdminHandler(func(req *http.Request) bool { return req.Header.Get("Authorization") == "Bearer admin" })
+	newRequest := func(method, url string) *http.Request {
+		req := httptest.NewRequest(method, url, nil)
+		req.Header.Set("Authorization", "Bearer admin")
+		return req
+	}
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest("GET", defaultAdminPath, nil))
+	_assert(w.Code == http.StatusForbidden, "expect admin without auth to be forbidden, got %d", w.Code)
+	w = httptest.NewRecorder()
+	server.AdminHandler(nil).ServeHTTP(w, newRequest("GET", defaultAdminPath))
+	_assert(w.Code == http.StatusForbidden, "expect admin with nil auth to be forbidden, got %d", w.Code)
+
+	var conns []adminConnection
+	for i := 0; i < 100; i++ {
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, newRequest("GET", defaultAdminPath))
+		_ = json.Unmarshal(w.Body.Bytes(), &conns)
+		if len(conns) == 1 && len(conns[0].InFlight) == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	_assert(len(conns) == 1 && len(conns[0].InFlight) == 1, "expect 1 in-flight request, got %+v", conns)
+	_assert(conns[0].InFlight[0].ServiceMethod == "Bar.Timeout", "unexpected in-flight request %+v", conns[0].InFlight[0])
+
+	w = httptest.NewRecorder()
+	url := fmt.Sprintf("%s?conn=%d&req=%d", defaultAdminPath, conns[0].ID, conns[0].InFlight[0].ID)
+	admin.ServeHTTP(w, newRequest("DELETE", url))
+	_assert(w.Code == 200, "cancel request failed: %s", w.Body.String())
+	select {
+	case call := <-call.Done:
+		_assert(call.Error != nil && strings.Contains(call.Error.Error(), "cancelled"), "expect a cancelled error, got %v", call.Error)
+	case <-time.After(time.Second):
+		t.Fatal("expect the call to be cancelled within 1s")
+	}
+}
+
+func TestServerConn_DuplicateSeq(t *testing.T) {
+	conn := &serverConn{requests: make(map[uint64]*request)}
+	h := &codec.Header{ServiceMethod: "Bar.Timeout", Seq: 1}
+	a, b := &request{h: h}, &request{h: h}
+	conn.addRequest(a)
+	conn.addRequest(b) // 客户端重复使用Seq时两个请求都可以被看到和取消
+	_assert(a.id != b.id && len(conn.requests) == 2, "expect requests with the same seq to be tracked separately")
+	conn.removeRequest(a)
+	_assert(conn.requests[b.id] == b, "expect removing one request to keep the other")
+}
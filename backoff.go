@@ -0,0 +1,18 @@
+package geerpc
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// 指数退避：initial * multiplier^attempt 不超过max 再加上±jitter比例的随机抖动
+// 客户端重连、XClient重试、实例摘除时间以及心跳和服务发现失败后的重试都使用它 attempt从0开始
+func Backoff(initial, max time.Duration, multiplier, jitter float64, attempt int) time.Duration {
+	d := float64(initial) * math.Pow(multiplier, float64(attempt))
+	if d > float64(max) {
+		d = float64(max)
+	}
+	d *= 1 + jitter*(rand.Float64()*2-1)
+	return time.Duration(d)
+}
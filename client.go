@@ -24,10 +24,12 @@ type Call struct {
 	Reply         interface{}
 	Error         error
 	Done          chan *Call // 用于支持异步调用
+	span          *Span      // 本次调用的client span 未开启追踪时为nil
 }
 
 // 通知调用方调用结束
 func (call *Call) done() {
+	call.span.Finish(call.Error)
 	call.Done <- call
 }
 
@@ -41,6 +43,7 @@ type Client struct {
 	pending  map[uint64]*Call // 存储未处理完的请求
 	closing  bool             // 用户主动关闭客户端
 	shutdown bool             // 有错误导致客户端关闭
+	done     chan struct{}    // 客户端关闭后（接收响应的goroutine退出）被关闭
 }
 
 var ErrShutdown = errors.New("connection is shut down")
@@ -63,6 +66,13 @@ func (client *Client) IsAvailable() bool { // 客户端是否可用
 	return !client.closing && !client.shutdown
 }
 
+// 正在等待响应的调用数 可用于衡量客户端的负载
+func (client *Client) NumPending() int {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return len(client.pending)
+}
+
 // 在客户端中添加Call
 func (client *Client) registerCall(call *Call) (uint64, error) {
 	client.mu.Lock()
@@ -97,6 +107,12 @@ func (client *Client) terminateCall(err error) {
 		call.Error = err
 		call.done()
 	}
+	close(client.done)
+}
+
+// 返回一个channel 客户端不可用后被关闭 可用于感知连接断开
+func (client *Client) Done() <-chan struct{} {
+	return client.done
 }
 
 /* ****************************************************
@@ -134,16 +150,20 @@ func NewClient(conn net.Conn, opt *Option) (*Client, error) {
 	f := codec.NewCodecFuncMap[opt.CodecType]
 	if f == nil {
 		err := fmt.Errorf("invalid codec type %s", opt.CodecType)
-		log.Println("rpc client: codec error: ", err)
+		opt.logger().Printf("rpc client: codec error: %v", err)
 		return nil, err
 	}
 	// 必须成功发送option才能成功创建客户端
 	if err := json.NewEncoder(conn).Encode(opt); err != nil {
-		log.Println("rpc client: options error: ", err)
+		opt.logger().Printf("rpc client: options error: %v", err)
 		_ = conn.Close()
 		return nil, err
 	}
-	return newClientCodec(f(conn), opt), nil
+	cc := f(conn)
+	if ls, ok := cc.(codec.LoggerSetter); ok {
+		ls.SetLogger(opt.logger())
+	}
+	return newClientCodec(cc, opt), nil
 }
 
 func newClientCodec(cc codec.Codec, opt *Option) *Client {
@@ -152,6 +172,7 @@ func newClientCodec(cc codec.Codec, opt *Option) *Client {
 		cc:      cc,
 		opt:     opt,
 		pending: make(map[uint64]*Call),
+		done:    make(chan struct{}),
 	}
 	go client.receive() // 异步接收响应
 	return client
@@ -165,12 +186,12 @@ func parseOptions(opts ...*Option) (*Option, error) {
 	if len(opts) != 1 {
 		return nil, errors.New("number of option is more than 1")
 	}
-	opt := opts[0]
+	opt := *opts[0] // 复制一份 同一个Option可能被并发建立的多个连接共用
 	opt.MagicNumber = DefaultOption.MagicNumber
 	if opt.CodecType == "" {
 		opt.CodecType = DefaultOption.CodecType
 	}
-	return opt, nil
+	return &opt, nil
 }
 
 // 创建客户端的入口 一个客户端只处理一个连接(address)的信息
@@ -207,6 +228,10 @@ func (client *Client) send(call *Call) {
 	client.header.Seq = seq
 	client.header.ServiceMethod = call.ServiceMethod
 	client.header.Error = ""
+	client.header.TraceID, client.header.SpanID = "", ""
+	if call.span != nil {
+		client.header.TraceID, client.header.SpanID = call.span.TraceID, call.span.SpanID
+	}
 
 	// 编码——发送 body为请求参数
 	if err := client.cc.Write(&client.header, call.Args); err != nil {
@@ -220,6 +245,11 @@ func (client *Client) send(call *Call) {
 
 // 异步发起的RPC调用
 func (client *Client) Go(serviceMethod string, args, reply interface{}, done chan *Call) *Call {
+	return client.goContext(context.Background(), serviceMethod, args, reply, done)
+}
+
+// ctx仅用于获取父span 以便把本次调用挂到已有的调用链上
+func (client *Client) goContext(ctx context.Context, serviceMethod string, args, reply interface{}, done chan *Call) *Call {
 	if done == nil {
 		done = make(chan *Call, 1)
 	} else if cap(done) == 0 {
@@ -231,6 +261,7 @@ func (client *Client) Go(serviceMethod string, args, reply interface{}, done cha
 		Reply:         reply,
 		Done:          done,
 	}
+	_, call.span = client.opt.Tracer.StartSpan(ctx, serviceMethod, SpanKindClient)
 	client.send(call)
 	return call // 异步体现在没有等待调用完成：call.done()
 }
@@ -238,11 +269,13 @@ func (client *Client) Go(serviceMethod string, args, reply interface{}, done cha
 // 同步RPC调用 使用context由用户控制RPC调用的超时时间
 func (client *Client) Call(ctx context.Context, serviceMethod string, args, reply interface{}) error {
 	// 阻塞等待调用完成
-	call := client.Go(serviceMethod, args, reply, make(chan *Call, 1))
+	call := client.goContext(ctx, serviceMethod, args, reply, make(chan *Call, 1))
 	select {
 	case <-ctx.Done():
 		client.removeCall(call.Seq)
-		return errors.New("rpc client: call failed: " + ctx.Err().Error())
+		err := errors.New("rpc client: call failed: " + ctx.Err().Error())
+		call.span.Finish(err)
+		return err
 	case call := <-call.Done:
 		return call.Error
 	}
@@ -6,6 +6,8 @@ type Header struct {
 	ServiceMethod string // "格式为：Service.Method"
 	Seq           uint64 // 客户端请求的序列号
 	Error         string // 存储服务端的错误信息
+	TraceID       string // 链路追踪ID 同一条调用链上的所有span共享
+	SpanID        string // 客户端span的ID 作为服务端span的父节点
 }
 
 // 编解码消息体的接口(可以实现不同的Codec实例，即不同编码方式)
@@ -17,6 +19,16 @@ type Codec interface {
 	Write(*Header, interface{}) error
 }
 
+// 编解码出错时的日志输出 geerpc.Logger和*log.Logger都满足该接口
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// 可选接口 Server和Client创建Codec后通过它设置日志输出 未实现时Codec自行决定如何输出
+type LoggerSetter interface {
+	SetLogger(Logger)
+}
+
 type NewCodecFunc func(io.ReadWriteCloser) Codec
 type Type string
 
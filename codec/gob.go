@@ -12,9 +12,13 @@ type GobCodec struct { // 实现Codec接口的所有方法
 	buf  *bufio.Writer      // 防止阻塞的带缓冲Writer
 	dec  *gob.Decoder
 	enc  *gob.Encoder
+	log  Logger // 为nil时使用标准库log包
 }
 
-var _ Codec = (*GobCodec)(nil)
+var (
+	_ Codec        = (*GobCodec)(nil)
+	_ LoggerSetter = (*GobCodec)(nil)
+)
 
 func NewGobCodec(conn io.ReadWriteCloser) Codec {
 	buf := bufio.NewWriter(conn)
@@ -26,6 +30,18 @@ func NewGobCodec(conn io.ReadWriteCloser) Codec {
 	}
 }
 
+func (c *GobCodec) SetLogger(logger Logger) {
+	c.log = logger
+}
+
+func (c *GobCodec) logf(format string, v ...interface{}) {
+	if c.log == nil {
+		log.Printf(format, v...)
+		return
+	}
+	c.log.Printf(format, v...)
+}
+
 // 读操作——解码decode
 // Decode方法：从socket连接conn中读取内容存储在参数中
 func (c *GobCodec) ReadHeader(h *Header) error {
@@ -46,11 +62,11 @@ func (c *GobCodec) Write(h *Header, body interface{}) (err error) {
 		}
 	}()
 	if err = c.enc.Encode(h); err != nil {
-		log.Println("rpc codec: gob error encoding header:", err)
+		c.logf("rpc codec: gob error encoding header: %v", err)
 		return err
 	}
 	if err = c.enc.Encode(body); err != nil {
-		log.Println("rpc codec: gob error encoding body:", err)
+		c.logf("rpc codec: gob error encoding body: %v", err)
 		return err
 	}
 	return nil
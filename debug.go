@@ -1,28 +1,53 @@
 package geerpc
 
 import (
+	"encoding/json"
 	"fmt"
 	"html/template"
 	"net/http"
+	"sort"
+	"strings"
+	"time"
 )
 
 const debugText = `<html>
 	<body>
 	<title>GeeRPC Services</title>
-	{{range .}}
+	{{range .Services}}
 	<hr>
 	Service {{.Name}}
 	<hr>
 		<table>
-		<th align=center> Method</th><th align=center> Calls</th>
-		{{range $name, $mtype := .Method}}
+		<th align=center> Method</th><th align=center> Calls</th><th align=center> Errors</th><th align=center> In-flight</th>
+		<th align=center> Avg</th><th align=center> P50</th><th align=center> P90</th><th align=center> P99</th>
+		{{range .Methods}}
 			<tr>
-			<td align=left front=fixed>{{$name}}({{$mtype.ArgType}}, {{$mtype.ReplyType}}) error</td>
-			<td align=center>{{$mtype.NumCalls}}</td>
+			<td align=left front=fixed>{{.Name}}({{.ArgType}}, {{.ReplyType}}) error</td>
+			<td align=center>{{.Calls}}</td>
+			<td align=center>{{.Errors}}</td>
+			<td align=center>{{.InFlight}}</td>
+			<td align=center>{{.AvgLatency}}</td>
+			<td align=center>{{.P50}}</td>
+			<td align=center>{{.P90}}</td>
+			<td align=center>{{.P99}}</td>
 			</tr>
 		{{end}}
 		</table>
 	{{end}}
+	<hr>
+	Connections
+	<hr>
+		<table>
+		<th align=center> Remote</th><th align=center> Codec</th><th align=center> Handle Timeout</th><th align=center> Since</th>
+		{{range .Connections}}
+			<tr>
+			<td align=left>{{.RemoteAddr}}</td>
+			<td align=center>{{.CodecType}}</td>
+			<td align=center>{{.HandleTimeout}}</td>
+			<td align=center>{{.Since}}</td>
+			</tr>
+		{{end}}
+		</table>
 	</body>
 	</html>`
 
@@ -32,23 +57,91 @@ type debugHTTP struct {
 	*Server
 }
 
+// 调试页面展示的数据 同时用于HTML和JSON两种格式
+type debugInfo struct {
+	Services    []debugService    `json:"services"`
+	Connections []debugConnection `json:"connections"`
+}
+
 type debugService struct {
-	Name   string
-	Method map[string]*methodType
+	Name    string        `json:"name"`
+	Methods []debugMethod `json:"methods"`
+}
+
+type debugMethod struct {
+	Name       string `json:"name"`
+	ArgType    string `json:"arg_type"`
+	ReplyType  string `json:"reply_type"`
+	Calls      uint64 `json:"calls"`
+	Errors     uint64 `json:"errors"`
+	InFlight   int64  `json:"in_flight"`
+	AvgLatency string `json:"avg_latency"`
+	P50        string `json:"p50"`
+	P90        string `json:"p90"`
+	P99        string `json:"p99"`
+}
+
+// 每个连接都由客户端发送的Option协商编码方式和超时时间
+type debugConnection struct {
+	RemoteAddr    string `json:"remote_addr"`
+	CodecType     string `json:"codec"`
+	HandleTimeout string `json:"handle_timeout"`
+	Since         string `json:"since"`
 }
 
 func (server debugHTTP) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	var services []debugService
+	info := server.debugInfo()
+	if req.URL.Query().Get("format") == "json" || strings.Contains(req.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(info); err != nil {
+			server.logger.Printf("rpc: error encoding debug info: %v", err)
+		}
+		return
+	}
+	err := debug.Execute(w, info)
+	if err != nil {
+		_, _ = fmt.Fprintln(w, "rpc: error executing template: ", err.Error())
+	}
+}
+
+func (server debugHTTP) debugInfo() *debugInfo {
+	info := &debugInfo{
+		Services:    make([]debugService, 0),
+		Connections: make([]debugConnection, 0),
+	}
 	server.serviceMap.Range(func(namei, svci interface{}) bool { // Range用于遍历syncMap并对每个键值对执行作为参数的函数
 		svc := svci.(*service)
-		services = append(services, debugService{
-			Name:   namei.(string),
-			Method: svc.method,
-		})
+		ds := debugService{Name: namei.(string)}
+		for _, name := range svc.methodNames() {
+			mtype := svc.method[name]
+			ds.Methods = append(ds.Methods, debugMethod{
+				Name:       name,
+				ArgType:    mtype.ArgType.String(),
+				ReplyType:  mtype.ReplyType.String(),
+				Calls:      mtype.NumCalls(),
+				Errors:     mtype.NumErrors(),
+				InFlight:   mtype.InFlight(),
+				AvgLatency: mtype.AvgLatency().String(),
+				P50:        mtype.LatencyPercentile(0.5).String(),
+				P90:        mtype.LatencyPercentile(0.9).String(),
+				P99:        mtype.LatencyPercentile(0.99).String(),
+			})
+		}
+		info.Services = append(info.Services, ds)
 		return true
 	})
-	err := debug.Execute(w, services)
-	if err != nil {
-		_, _ = fmt.Fprintln(w, "rpc: error executing template: ", err.Error())
+	sort.Slice(info.Services, func(i, j int) bool { return info.Services[i].Name < info.Services[j].Name })
+
+	server.mu.Lock()
+	for _, conn := range server.conns {
+		info.Connections = append(info.Connections, debugConnection{
+			RemoteAddr:    conn.remoteAddr,
+			CodecType:     string(conn.opt.CodecType),
+			HandleTimeout: conn.opt.HandleTimeout.String(),
+			Since:         conn.start.Format(time.RFC3339),
+		})
 	}
+	server.mu.Unlock()
+	sort.Slice(info.Connections, func(i, j int) bool { return info.Connections[i].Since < info.Connections[j].Since })
+	return info
 }
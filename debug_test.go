@@ -0,0 +1,34 @@
+package geerpc
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDebugHTTP_JSON(t *testing.T) {
+	var foo Foo
+	server := NewServer()
+	server.SetLogger(nil)
+	_ = server.Register(&foo)
+	l, _ := net.Listen("tcp", ":0")
+	defer l.Close()
+	go server.Accept(l)
+
+	client, err := Dial("tcp", l.Addr().String())
+	_assert(err == nil, "dial error: %v", err)
+	defer client.Close()
+	var reply int
+	_ = client.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+
+	w := httptest.NewRecorder()
+	debugHTTP{server}.ServeHTTP(w, httptest.NewRequest("GET", defaultDebugPath+"?format=json", nil))
+	var info debugInfo
+	_assert(json.Unmarshal(w.Body.Bytes(), &info) == nil, "debug page is not json: %s", w.Body.String())
+	_assert(len(info.Services) == 1 && len(info.Services[0].Methods) == 1, "expect 1 service with 1 method")
+	m := info.Services[0].Methods[0]
+	_assert(m.Name == "Sum" && m.Calls == 1 && m.Errors == 0 && m.InFlight == 0, "unexpected method stats: %+v", m)
+	_assert(len(info.Connections) == 1 && info.Connections[0].CodecType == string(DefaultOption.CodecType), "unexpected connections: %+v", info.Connections)
+}
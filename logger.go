@@ -0,0 +1,77 @@
+package geerpc
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+// 日志接口 *log.Logger 即满足该接口 可用于重定向或关闭框架的日志输出
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+type stdLogger struct{} // 默认使用标准库log包 因此log.SetOutput等设置依然生效
+
+func (stdLogger) Printf(format string, v ...interface{}) {
+	log.Printf(format, v...)
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Printf(format string, v ...interface{}) {}
+
+var (
+	DefaultLogger Logger = stdLogger{}
+	NopLogger     Logger = nopLogger{} // 丢弃所有日志
+)
+
+// 访问日志的输出格式
+type AccessLogFormat int
+
+const (
+	AccessLogKeyValue AccessLogFormat = iota // key=value 形式
+	AccessLogJSON                            // 每条日志为一个JSON对象
+)
+
+const (
+	statusOK        = "ok"
+	statusError     = "error"
+	statusTimeout   = "timeout"
+	statusCancelled = "cancelled"
+)
+
+// 一次请求的访问日志
+type AccessLog struct {
+	RemoteAddr    string
+	ServiceMethod string
+	Seq           uint64
+	Duration      time.Duration
+	Status        string // ok / error / timeout / cancelled
+	Error         string
+	RequestSize   int64 // 请求报文（header+body）的字节数
+	ResponseSize  int64 // 响应报文（header+body）的字节数
+}
+
+func (l *AccessLog) format(f AccessLogFormat) string {
+	if f == AccessLogJSON {
+		b, _ := json.Marshal(struct {
+			RemoteAddr    string `json:"remote_addr"`
+			ServiceMethod string `json:"method"`
+			Seq           uint64 `json:"seq"`
+			Duration      string `json:"duration"`
+			Status        string `json:"status"`
+			Error         string `json:"error,omitempty"`
+			RequestSize   int64  `json:"req_bytes"`
+			ResponseSize  int64  `json:"resp_bytes"`
+		}{l.RemoteAddr, l.ServiceMethod, l.Seq, l.Duration.String(), l.Status, l.Error, l.RequestSize, l.ResponseSize})
+		return string(b)
+	}
+	s := fmt.Sprintf("remote=%s method=%s seq=%d duration=%s status=%s req_bytes=%d resp_bytes=%d",
+		l.RemoteAddr, l.ServiceMethod, l.Seq, l.Duration, l.Status, l.RequestSize, l.ResponseSize)
+	if l.Error != "" {
+		s += fmt.Sprintf(" error=%q", l.Error)
+	}
+	return s
+}
@@ -0,0 +1,81 @@
+package geerpc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"geerpc/codec"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type bufferLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *bufferLogger) Printf(format string, v ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+func (l *bufferLogger) Lines() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.lines...)
+}
+
+func TestServer_AccessLog(t *testing.T) {
+	var foo Foo
+	accessLog := &bufferLogger{}
+	server := NewServer()
+	server.SetLogger(nil)
+	server.SetAccessLog(accessLog, AccessLogJSON)
+	_ = server.Register(&foo)
+	l, _ := net.Listen("tcp", ":0")
+	defer l.Close()
+	go server.Accept(l)
+
+	client, err := Dial("tcp", l.Addr().String())
+	_assert(err == nil, "dial error: %v", err)
+	defer client.Close()
+	var reply int
+	_ = client.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+	_ = client.Call(context.Background(), "Foo.Unknown", &Args{}, &reply)
+
+	lines := accessLog.Lines()
+	_assert(len(lines) == 2, "expect 2 access logs, got %d", len(lines))
+	var entries [2]map[string]interface{}
+	for i, line := range lines {
+		_assert(json.Unmarshal([]byte(line), &entries[i]) == nil, "access log is not json: %s", line)
+	}
+	_assert(entries[0]["method"] == "Foo.Sum" && entries[0]["status"] == statusOK, "unexpected access log: %s", lines[0])
+	_assert(entries[0]["req_bytes"].(float64) > 0 && entries[0]["resp_bytes"].(float64) > 0, "expect request and response size: %s", lines[0])
+	_assert(entries[1]["status"] == statusError && entries[1]["error"] != nil, "unexpected access log: %s", lines[1])
+}
+
+func TestCodec_Logger(t *testing.T) {
+	var foo Foo
+	server := NewServer()
+	server.SetLogger(nil)
+	_ = server.Register(&foo)
+	l, _ := net.Listen("tcp", ":0")
+	defer l.Close()
+	go server.Accept(l)
+
+	logger := &bufferLogger{}
+	client, err := Dial("tcp", l.Addr().String(), &Option{MagicNumber: MagicNumber, CodecType: codec.GobType, Logger: logger})
+	_assert(err == nil, "dial error: %v", err)
+	defer client.Close()
+	var reply int
+	err = client.Call(context.Background(), "Foo.Sum", struct{ C chan int }{}, &reply)
+	_assert(err != nil, "expect encoding error")
+	found := false
+	for _, line := range logger.Lines() {
+		found = found || strings.HasPrefix(line, "rpc codec: gob error encoding body")
+	}
+	_assert(found, "expect codec error in client logger, got %v", logger.Lines())
+}
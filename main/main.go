@@ -42,7 +42,7 @@ func foo(xc *xclient.XClient, ctx context.Context, typ, serviceMethod string, ar
 }
 
 func call(registry string) {
-	d := xclient.NewGeeRegistryDiscovery(registry, 0)
+	d := xclient.NewGeeRegistryDiscoveryForService(registry, "Foo", 0)
 	xc := xclient.NewXClient(d, xclient.RandomSelect, nil)
 	defer xc.Close()
 	var wg sync.WaitGroup
@@ -57,7 +57,7 @@ func call(registry string) {
 }
 
 func broadcast(registry string) {
-	d := xclient.NewGeeRegistryDiscovery(registry, 0)
+	d := xclient.NewGeeRegistryDiscoveryForService(registry, "Foo", 0)
 	xc := xclient.NewXClient(d, xclient.RandomSelect, nil)
 	defer xc.Close()
 	var wg sync.WaitGroup
@@ -66,8 +66,9 @@ func broadcast(registry string) {
 		go func(i int) {
 			defer wg.Done()
 			foo(xc, context.Background(), "broadcast", "Foo.Sum", &Args{Num1: i, Num2: i * i})
-			ctx, _ := context.WithTimeout(context.Background(), time.Second*2)
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
 			foo(xc, ctx, "broadcast", "Foo.Sleep", &Args{Num1: i, Num2: i * i})
+			cancel()
 		}(i)
 	}
 	wg.Wait()
@@ -84,7 +85,7 @@ func startServer(registryAddr string, wg *sync.WaitGroup) {
 		log.Fatal("register error: ", err)
 	}
 	log.Println("start rpc server on", l.Addr())
-	registry.Heartbeat(registryAddr, "tcp@"+l.Addr().String(), 0)
+	registry.HeartbeatServer(registryAddr, "tcp@"+l.Addr().String(), server, 0)
 	wg.Done()
 	server.Accept(l)
 }
@@ -0,0 +1,269 @@
+package geerpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+/* ****************************************************
+自动重连的客户端：底层Client断开后按指数退避（带随机抖动）
+重新连接原地址，重新发送Option完成协商
+**************************************************** */
+
+type ConnState int
+
+const (
+	StateConnecting   ConnState = iota // 正在建立连接（包括断开后重连）
+	StateConnected                     // 连接可用
+	StateDisconnected                  // 连接断开 等待下一次重连
+	StateClosed                        // 用户主动关闭或超过最大重连次数
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateDisconnected:
+		return "disconnected"
+	case StateClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+type ReconnectPolicy struct {
+	InitialBackoff time.Duration // 第一次重连前的等待时间 默认100ms
+	MaxBackoff     time.Duration // 等待时间的上限 默认30s
+	Multiplier     float64       // 每次重连失败后等待时间的倍数 默认2
+	Jitter         float64       // 随机抖动比例 取值[0,1] 避免大量客户端同时重连
+	MaxAttempts    int           // 连续重连失败的最大次数 0表示不限制
+	// 连接不可用期间发起的调用：true表示等待重连成功（受ctx控制），false表示立即返回ErrShutdown
+	// 已经发送出去的调用在连接断开时总是返回错误 因为无法确定服务端是否已经处理
+	QueueCalls bool
+	// 连接状态变化的回调 只在内部的一个goroutine中按变化的顺序依次调用 不要阻塞
+	// StateClosed总是最后一次回调 Close返回时可能还没有调用
+	OnStateChange func(state ConnState)
+}
+
+var DefaultReconnectPolicy = &ReconnectPolicy{
+	InitialBackoff: time.Millisecond * 100,
+	MaxBackoff:     time.Second * 30,
+	Multiplier:     2,
+	Jitter:         0.2,
+}
+
+// 第attempt次重连前的等待时间 attempt从0开始
+func (p *ReconnectPolicy) backoff(attempt int) time.Duration {
+	return Backoff(p.InitialBackoff, p.MaxBackoff, p.Multiplier, p.Jitter, attempt)
+}
+
+func parsePolicy(policy *ReconnectPolicy) *ReconnectPolicy {
+	if policy == nil {
+		return DefaultReconnectPolicy
+	}
+	p := *policy
+	if p.InitialBackoff <= 0 {
+		p.InitialBackoff = DefaultReconnectPolicy.InitialBackoff
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = DefaultReconnectPolicy.MaxBackoff
+	}
+	if p.Multiplier < 1 {
+		p.Multiplier = DefaultReconnectPolicy.Multiplier
+	}
+	return &p
+}
+
+type ReconnectClient struct {
+	rpcAddr string // protocol@addr 与XDial的格式相同
+	opt     *Option
+	policy  *ReconnectPolicy
+	mu      sync.Mutex
+	client  *Client
+	state   ConnState
+	changed chan struct{} // 每次状态变化时关闭并替换 用于唤醒等待重连的调用
+	closed  chan struct{} // 状态变为StateClosed时关闭 用于唤醒watch
+}
+
+var _ io.Closer = (*ReconnectClient)(nil)
+
+// 创建自动重连的客户端 第一次连接失败直接返回错误
+func NewReconnectClient(rpcAddr string, policy *ReconnectPolicy, opts ...*Option) (*ReconnectClient, error) {
+	opt, err := parseOptions(opts...)
+	if err != nil {
+		return nil, err
+	}
+	client, err := XDial(rpcAddr, opt)
+	if err != nil {
+		return nil, err
+	}
+	rc := &ReconnectClient{
+		rpcAddr: rpcAddr,
+		opt:     opt,
+		policy:  parsePolicy(policy),
+		client:  client,
+		state:   StateConnected,
+		changed: make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+	go rc.watch(client)
+	return rc, nil
+}
+
+func (rc *ReconnectClient) State() ConnState {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.state
+}
+
+// 更新连接状态 需要持有rc.mu 已经关闭时返回false
+func (rc *ReconnectClient) setStateLocked(state ConnState) bool {
+	if rc.state == StateClosed {
+		return false
+	}
+	if rc.state != state {
+		rc.state = state
+		close(rc.changed)
+		rc.changed = make(chan struct{})
+	}
+	return true
+}
+
+// 只在watch中调用 状态变化才会通知 已经关闭时返回false
+func (rc *ReconnectClient) setState(state ConnState) bool {
+	rc.mu.Lock()
+	prev := rc.state
+	ok := rc.setStateLocked(state)
+	rc.mu.Unlock()
+	if ok && prev != state {
+		rc.notify(state)
+	}
+	return ok
+}
+
+// 回调只在watch所在的goroutine中调用 因此与状态变化的顺序相同
+func (rc *ReconnectClient) notify(state ConnState) {
+	if rc.policy.OnStateChange != nil {
+		rc.policy.OnStateChange(state)
+	}
+}
+
+// 等待当前连接断开 然后不断重连直到成功、客户端被关闭或超过最大重连次数
+func (rc *ReconnectClient) watch(client *Client) {
+	defer rc.notify(StateClosed)
+	for {
+		select {
+		case <-client.Done():
+		case <-rc.closed:
+			return
+		}
+		if !rc.setState(StateDisconnected) {
+			return
+		}
+		if client = rc.reconnect(); client == nil {
+			return
+		}
+	}
+}
+
+func (rc *ReconnectClient) reconnect() *Client {
+	for attempt := 0; rc.policy.MaxAttempts == 0 || attempt < rc.policy.MaxAttempts; attempt++ {
+		select {
+		case <-time.After(rc.policy.backoff(attempt)):
+		case <-rc.closed:
+			return nil
+		}
+		if !rc.setState(StateConnecting) {
+			return nil
+		}
+		client, err := XDial(rc.rpcAddr, rc.opt)
+		if err != nil {
+			rc.opt.logger().Printf("rpc client: reconnect %s error: %v", rc.rpcAddr, err)
+			if !rc.setState(StateDisconnected) {
+				return nil
+			}
+			continue
+		}
+		rc.mu.Lock()
+		if !rc.setStateLocked(StateConnected) { // 重连期间被关闭
+			rc.mu.Unlock()
+			_ = client.Close()
+			return nil
+		}
+		rc.client = client
+		rc.mu.Unlock()
+		rc.notify(StateConnected)
+		return client
+	}
+	rc.opt.logger().Printf("rpc client: give up reconnecting %s after %d attempts", rc.rpcAddr, rc.policy.MaxAttempts)
+	rc.markClosed()
+	return nil
+}
+
+// 获取可用的Client 按照QueueCalls决定是否等待重连
+func (rc *ReconnectClient) getClient(ctx context.Context) (*Client, error) {
+	for {
+		rc.mu.Lock()
+		state, client, changed := rc.state, rc.client, rc.changed
+		rc.mu.Unlock()
+		switch {
+		case state == StateClosed:
+			return nil, ErrShutdown
+		case state == StateConnected && client.IsAvailable():
+			return client, nil
+		case !rc.policy.QueueCalls:
+			return nil, ErrShutdown
+		}
+		// 连接已经断开但watch还未更新状态时 同样等待下一次状态变化
+		select {
+		case <-ctx.Done():
+			return nil, errors.New("rpc client: call failed: " + ctx.Err().Error())
+		case <-changed:
+		}
+	}
+}
+
+func (rc *ReconnectClient) Call(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	for {
+		client, err := rc.getClient(ctx)
+		if err != nil {
+			return err
+		}
+		err = client.Call(ctx, serviceMethod, args, reply)
+		// ErrShutdown说明请求还没有发送出去 开启QueueCalls时可以安全地等待重连后再发送
+		if err == ErrShutdown && rc.policy.QueueCalls {
+			continue
+		}
+		return err
+	}
+}
+
+// 把状态设置为StateClosed并返回当前的Client 已经关闭时返回nil
+// StateClosed的回调由watch在退出时调用
+func (rc *ReconnectClient) markClosed() *Client {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.state == StateClosed {
+		return nil
+	}
+	rc.state = StateClosed
+	close(rc.changed)
+	rc.changed = make(chan struct{})
+	close(rc.closed)
+	return rc.client
+}
+
+func (rc *ReconnectClient) Close() error {
+	client := rc.markClosed()
+	if client == nil {
+		return ErrShutdown
+	}
+	_ = client.Close()
+	return nil
+}
@@ -0,0 +1,92 @@
+package geerpc
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReconnectClient_Call(t *testing.T) {
+	var foo Foo
+	server := NewServer()
+	server.SetLogger(nil)
+	_ = server.Register(&foo)
+	l, _ := net.Listen("tcp", ":0")
+	defer l.Close()
+	go server.Accept(l)
+
+	states := make(chan ConnState, 16)
+	rc, err := NewReconnectClient("tcp@"+l.Addr().String(), &ReconnectPolicy{
+		InitialBackoff: time.Millisecond * 10,
+		QueueCalls:     true,
+		OnStateChange:  func(state ConnState) { states <- state },
+	}, &Option{Logger: NopLogger})
+	_assert(err == nil, "dial error: %v", err)
+	defer rc.Close()
+
+	var reply int
+	err = rc.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 3, "failed to call Foo.Sum: %v", err)
+
+	// 服务端主动关闭连接 客户端应当自动重连
+	_assert(server.CloseConn(1), "expect connection 1 to exist")
+	_assert(<-states == StateDisconnected, "expect state disconnected")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	err = rc.Call(ctx, "Foo.Sum", &Args{Num1: 2, Num2: 3}, &reply)
+	_assert(err == nil && reply == 5, "failed to call Foo.Sum after reconnect: %v", err)
+	_assert(rc.State() == StateConnected, "expect state connected, got %s", rc.State())
+
+	// 回调按状态变化的顺序依次调用 StateClosed是最后一次
+	_ = rc.Close()
+	var got []ConnState
+	for len(got) == 0 || got[len(got)-1] != StateClosed {
+		select {
+		case state := <-states:
+			got = append(got, state)
+		case <-time.After(time.Second):
+			t.Fatalf("expect state closed, got %v", got)
+		}
+	}
+	_assert(fmt.Sprint(got) == "[connecting connected closed]", "unexpected state changes: %v", got)
+	time.Sleep(time.Millisecond * 50)
+	_assert(len(states) == 0, "expect no state changes after closed")
+	_assert(rc.Call(context.Background(), "Foo.Sum", &Args{}, &reply) == ErrShutdown, "expect ErrShutdown after close")
+}
+
+func TestReconnectClient_GiveUp(t *testing.T) {
+	server := NewServer()
+	server.SetLogger(nil)
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+
+	states := make(chan ConnState, 16)
+	rc, err := NewReconnectClient("tcp@"+l.Addr().String(), &ReconnectPolicy{
+		InitialBackoff: time.Millisecond * 10,
+		MaxAttempts:    2,
+		OnStateChange:  func(state ConnState) { states <- state },
+	}, &Option{Logger: NopLogger})
+	_assert(err == nil, "dial error: %v", err)
+	_ = l.Close()
+	closed := false
+	for i := 0; i < 100 && !closed; i++ { // 服务端读取Option之后才记录连接
+		if closed = server.CloseConn(1); !closed {
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+	_assert(closed, "expect connection 1 to exist")
+
+	var got []ConnState
+	for len(got) == 0 || got[len(got)-1] != StateClosed {
+		select {
+		case state := <-states:
+			got = append(got, state)
+		case <-time.After(time.Second * 5):
+			t.Fatalf("expect state closed, got %v", got)
+		}
+	}
+	_assert(fmt.Sprint(got) == "[disconnected connecting disconnected connecting disconnected closed]", "unexpected state changes: %v", got)
+	_assert(rc.Close() == ErrShutdown, "expect ErrShutdown after giving up")
+}
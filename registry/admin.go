@@ -0,0 +1,345 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* *****************************************************
+管理接口：默认路径为注册中心路径加上/admin
+GET    列出服务和所有实例（包括不健康和被禁用的实例）及其元数据、距上次心跳的时长和健康状态
+       默认为HTML页面 带上format=json或Accept为application/json时以JSON返回
+POST   ?addr=&namespace=&disabled=true|false&weight=N 设置实例的覆盖配置 未给出的参数保持不变
+       被禁用的实例不在查询结果中返回 XClient会在已有调用完成后关闭它的连接
+       weight大于0时覆盖实例心跳上报的权重 为0时取消覆盖
+DELETE ?addr=&namespace= 取消实例的覆盖配置
+覆盖配置与心跳无关 实例重新注册后依然生效 直到被取消 开启存储和集群模式时同样持久化和同步
+开启认证时需要AdminPermission 只能看到和修改有权限的命名空间
+POST和DELETE需要带上X-Requested-With请求头 带有Origin请求头时必须与注册中心同源
+表单和跨域的简单请求无法满足这两个条件 以此防止跨站请求伪造
+***************************************************** */
+
+// 运维人员对实例的覆盖配置
+type Override struct {
+	Namespace string `json:"namespace,omitempty"`
+	Addr      string `json:"addr"`
+	Disabled  bool   `json:"disabled,omitempty"` // 禁用实例 查询时不返回
+	Weight    int    `json:"weight,omitempty"`   // 大于0时覆盖实例上报的权重
+	version   uint64 // 集群模式下的lamport版本
+	node      string
+	at        time.Time // 集群模式下取消覆盖的时间 空的覆盖配置与墓碑一样保留一段时间后删除
+}
+
+// 是否没有覆盖任何配置
+func (o *Override) empty() bool {
+	return !o.Disabled && o.Weight <= 0
+}
+
+// 设置实例的覆盖配置 Disabled为false且Weight为0时取消覆盖 实例不存在时同样生效
+func (r *GeeRegistry) SetOverride(o Override) {
+	defer r.flushStore()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if o.Weight < 0 {
+		o.Weight = 0
+	}
+	key := itemKey(o.Namespace, o.Addr)
+	old, ok := r.overrides[key]
+	if (ok && old.Disabled == o.Disabled && old.Weight == o.Weight) || (!ok && o.empty()) {
+		return
+	}
+	r.clock++
+	o.version, o.node = r.clock, r.node
+	r.putOverrideLocked(key, &o)
+	r.changeLocked()
+	r.persistOverrideLocked(o)
+	r.logger.Printf("rpc registry: override %s disabled=%v weight=%d", key, o.Disabled, o.Weight)
+}
+
+// 需要持有r.mu
+func (r *GeeRegistry) putOverrideLocked(key string, o *Override) {
+	if o.empty() && r.cluster == nil { // 集群模式下保留空的覆盖配置 用于向其他节点同步取消
+		delete(r.overrides, key)
+		return
+	}
+	if o.empty() {
+		o.at = time.Now()
+	}
+	r.overrides[key] = o
+}
+
+// 获取实例的覆盖配置
+func (r *GeeRegistry) GetOverride(namespace, addr string) (Override, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	o, ok := r.overrides[itemKey(namespace, addr)]
+	if !ok || o.empty() {
+		return Override{}, false
+	}
+	return *o, true
+}
+
+// 应用覆盖配置 返回实例是否被禁用 需要持有r.mu
+func (r *GeeRegistry) applyOverrideLocked(key string, item *ServerItem) bool {
+	o, ok := r.overrides[key]
+	if !ok {
+		return false
+	}
+	if o.Weight > 0 {
+		item.Weight = o.Weight
+	}
+	return o.Disabled
+}
+
+const adminText = `<html>
+	<body>
+	<title>GeeRPC Registry</title>
+	<hr>
+	Services
+	<hr>
+		<table>
+		<th align=center> Namespace</th><th align=center> Service</th><th align=center> Available</th><th align=center> Instances</th>
+		{{range .Services}}
+			<tr>
+			<td align=left>{{.Namespace}}</td>
+			<td align=left>{{.Name}}</td>
+			<td align=center>{{.Available}}</td>
+			<td align=center>{{.Instances}}</td>
+			</tr>
+		{{end}}
+		</table>
+	<hr>
+	Instances
+	<hr>
+		<table>
+		<th align=center> Namespace</th><th align=center> Addr</th><th align=center> Services</th><th align=center> Version</th>
+		<th align=center> Zone</th><th align=center> Tags</th><th align=center> Weight</th><th align=center> Last Heartbeat</th>
+		<th align=center> Health</th><th align=center> Status</th><th align=center> Override</th>
+		{{range .Instances}}
+			<tr>
+			<td align=left>{{.Namespace}}</td>
+			<td align=left>{{.Addr}}</td>
+			<td align=left>{{join .Services}}</td>
+			<td align=center>{{.Version}}</td>
+			<td align=center>{{.Zone}}</td>
+			<td align=left>{{join .Tags}}</td>
+			<td align=center>{{.Weight}}{{if .WeightOverride}} (reported {{.ReportedWeight}}){{end}}</td>
+			<td align=center>{{.LastHeartbeat}} ago</td>
+			<td align=center>{{.Health}}</td>
+			<td align=center>{{if .Disabled}}disabled{{else}}enabled{{end}}</td>
+			<td align=left>
+				{{if .Disabled}}<button onclick="override({namespace: {{.Namespace}}, addr: {{.Addr}}, disabled: 'false'})">Enable</button>{{else}}<button onclick="override({namespace: {{.Namespace}}, addr: {{.Addr}}, disabled: 'true'})">Disable</button>{{end}}
+				<input type="number" min="0" value="{{.WeightOverride}}" style="width:4em">
+				<button onclick="override({namespace: {{.Namespace}}, addr: {{.Addr}}, weight: this.previousElementSibling.value})">Set Weight</button>
+			</td>
+			</tr>
+		{{end}}
+		</table>
+	<script>
+	function override(params) {
+		fetch(location.pathname + '?' + new URLSearchParams(params), {method: 'POST', headers: {'X-Requested-With': 'XMLHttpRequest'}})
+			.then(function(resp) { return resp.ok ? location.reload() : resp.text().then(alert) })
+	}
+	</script>
+	</body>
+	</html>`
+
+var admin = template.Must(template.New("registry admin").Funcs(template.FuncMap{
+	"join": func(list []string) string { return strings.Join(list, ",") },
+}).Parse(adminText))
+
+type adminHTTP struct {
+	*GeeRegistry
+}
+
+// 管理页面展示的数据 同时用于HTML和JSON两种格式
+type adminInfo struct {
+	Index     uint64          `json:"index"`
+	Services  []adminService  `json:"services"`
+	Instances []adminInstance `json:"instances"`
+	Overrides []Override      `json:"overrides"` // 包括实例已经不存在的覆盖配置
+}
+
+type adminService struct {
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+	Available int    `json:"available"` // 查询时会返回的实例数
+	Instances int    `json:"instances"`
+}
+
+type adminInstance struct {
+	ServerItem
+	ReportedWeight int    `json:"reported_weight"` // 心跳上报的权重
+	WeightOverride int    `json:"weight_override,omitempty"`
+	Disabled       bool   `json:"disabled,omitempty"`
+	LastHeartbeat  string `json:"last_heartbeat"` // 距上次心跳的时长
+	Health         string `json:"health"`         // healthy、unhealthy 未开启主动探测或还没有探测时为unknown
+}
+
+// 管理接口的http.Handler 使用HandleHTTP时注册在注册中心路径加上/admin
+func (r *GeeRegistry) AdminHandler() http.Handler {
+	return adminHTTP{r}
+}
+
+func (r adminHTTP) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+		cred, enabled := r.credential(requestToken(req))
+		if enabled && (cred == nil || cred.Permission&AdminPermission == 0) {
+			code := http.StatusForbidden
+			if cred == nil {
+				w.Header().Set("WWW-Authenticate", `Basic realm="geerpc registry"`)
+				code = http.StatusUnauthorized
+			}
+			http.Error(w, http.StatusText(code), code)
+			return
+		}
+		info := r.adminInfo(func(namespace string) bool { return !enabled || cred.allow(namespace, AdminPermission) })
+		if req.URL.Query().Get("format") == "json" || strings.Contains(req.Header.Get("Accept"), "application/json") {
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(info); err != nil {
+				r.logger.Printf("rpc registry: error encoding admin info: %v", err)
+			}
+			return
+		}
+		if err := admin.Execute(w, info); err != nil {
+			_, _ = fmt.Fprintln(w, "rpc registry: error executing template: ", err.Error())
+		}
+	case "POST":
+		if !sameOriginRequest(w, req) {
+			return
+		}
+		addr := req.FormValue("addr")
+		if addr == "" {
+			http.Error(w, "rpc registry: missing server address", http.StatusBadRequest)
+			return
+		}
+		if !r.authorizeHTTP(w, req, req.FormValue("namespace"), AdminPermission) {
+			return
+		}
+		o, _ := r.GetOverride(req.FormValue("namespace"), addr)
+		o.Namespace, o.Addr = req.FormValue("namespace"), addr
+		if v := req.FormValue("disabled"); v != "" {
+			disabled, err := strconv.ParseBool(v)
+			if err != nil {
+				http.Error(w, "rpc registry: invalid disabled", http.StatusBadRequest)
+				return
+			}
+			o.Disabled = disabled
+		}
+		if v := req.FormValue("weight"); v != "" {
+			weight, err := strconv.Atoi(v)
+			if err != nil || weight < 0 {
+				http.Error(w, "rpc registry: invalid weight", http.StatusBadRequest)
+				return
+			}
+			o.Weight = weight
+		}
+		r.SetOverride(o)
+	case "DELETE":
+		if !sameOriginRequest(w, req) {
+			return
+		}
+		namespace, addr := req.URL.Query().Get("namespace"), req.URL.Query().Get("addr")
+		if !r.authorizeHTTP(w, req, namespace, AdminPermission) {
+			return
+		}
+		if _, ok := r.GetOverride(namespace, addr); !ok {
+			http.Error(w, "rpc registry: override not found", http.StatusNotFound)
+			return
+		}
+		r.SetOverride(Override{Namespace: namespace, Addr: addr})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// 修改覆盖配置的请求需要带上X-Requested-With 且不能来自其他源 不满足时返回403
+func sameOriginRequest(w http.ResponseWriter, req *http.Request) bool {
+	if req.Header.Get("X-Requested-With") == "" {
+		http.Error(w, "rpc registry: missing X-Requested-With header", http.StatusForbidden)
+		return false
+	}
+	if origin := req.Header.Get("Origin"); origin != "" {
+		if u, err := url.Parse(origin); err != nil || u.Host != req.Host {
+			http.Error(w, "rpc registry: cross-origin request is not allowed", http.StatusForbidden)
+			return false
+		}
+	}
+	return true
+}
+
+// allowed为可以查看的命名空间
+func (r adminHTTP) adminInfo(allowed func(namespace string) bool) *adminInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	info := &adminInfo{
+		Index:     r.index,
+		Services:  make([]adminService, 0),
+		Instances: make([]adminInstance, 0, len(r.servers)),
+		Overrides: make([]Override, 0, len(r.overrides)),
+	}
+	services := make(map[string]*adminService)
+	for key, s := range r.servers {
+		if r.timeout > 0 && !s.start.Add(r.timeout).After(now) { // 已经过期 下次查询时删除
+			continue
+		}
+		if !allowed(s.Namespace) {
+			continue
+		}
+		inst := adminInstance{ServerItem: *s, ReportedWeight: s.Weight, LastHeartbeat: now.Sub(s.start).String(), Health: "unknown"}
+		inst.Disabled = r.applyOverrideLocked(key, &inst.ServerItem)
+		if o, ok := r.overrides[key]; ok {
+			inst.WeightOverride = o.Weight
+		}
+		if h, ok := r.health[key]; ok {
+			inst.Health = "healthy"
+			if h.unhealthy {
+				inst.Health = "unhealthy"
+			}
+		}
+		info.Instances = append(info.Instances, inst)
+		available := !inst.Disabled && !r.unhealthyLocked(key)
+		for _, name := range s.Services {
+			svcKey := itemKey(s.Namespace, name)
+			svc, ok := services[svcKey]
+			if !ok {
+				svc = &adminService{Namespace: s.Namespace, Name: name}
+				services[svcKey] = svc
+			}
+			svc.Instances++
+			if available {
+				svc.Available++
+			}
+		}
+	}
+	for _, svc := range services {
+		info.Services = append(info.Services, *svc)
+	}
+	for _, o := range r.overrides {
+		if !o.empty() && allowed(o.Namespace) {
+			info.Overrides = append(info.Overrides, *o)
+		}
+	}
+	sort.Slice(info.Services, func(i, j int) bool {
+		a, b := info.Services[i], info.Services[j]
+		return a.Namespace < b.Namespace || (a.Namespace == b.Namespace && a.Name < b.Name)
+	})
+	sort.Slice(info.Instances, func(i, j int) bool {
+		a, b := info.Instances[i], info.Instances[j]
+		return a.Namespace < b.Namespace || (a.Namespace == b.Namespace && a.Addr < b.Addr)
+	})
+	sort.Slice(info.Overrides, func(i, j int) bool {
+		a, b := info.Overrides[i], info.Overrides[j]
+		return a.Namespace < b.Namespace || (a.Namespace == b.Namespace && a.Addr < b.Addr)
+	})
+	return info
+}
@@ -0,0 +1,141 @@
+package registry
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+/* *****************************************************
+认证和命名空间隔离：开启认证后每个请求都需要带上token，token决定
+可以访问哪些命名空间以及在这些命名空间中的权限：
+1. ReadPermission  查询和长轮询
+2. WritePermission 注册、心跳和注销
+3. AdminPermission 管理页面 集群节点之间的同步需要所有命名空间的AdminPermission
+HTTP请求的token放在 Authorization: Bearer <token> 中 或者作为Basic认证的密码
+因此注册中心地址可以写成 http://:token@host:port/_geerpc_/registry
+不支持把token作为用户名（http://token@host） net/http只会在错误信息中隐去密码 用户名中的token会出现在日志里
+心跳、服务发现和集群同步会自动带上
+geerpc协议的token在调用参数中 见RegistryClient.SetToken
+***************************************************** */
+
+type Permission int
+
+const (
+	ReadPermission Permission = 1 << iota
+	WritePermission
+	AdminPermission
+)
+
+const AllNamespaces = "*" // 表示所有命名空间
+
+// 一个token的权限
+type Credential struct {
+	Namespaces []string // 可以访问的命名空间 空字符串为默认命名空间 AllNamespaces表示所有命名空间
+	Permission Permission
+}
+
+// 是否有namespace中的权限perm namespace为AllNamespaces时需要所有命名空间的权限
+func (c *Credential) allow(namespace string, perm Permission) bool {
+	if c.Permission&perm != perm {
+		return false
+	}
+	return contains(c.Namespaces, AllNamespaces) || (namespace != AllNamespaces && contains(c.Namespaces, namespace))
+}
+
+type tokenCredential struct {
+	token string
+	cred  Credential
+}
+
+var (
+	errUnauthorized = errors.New("rpc registry: missing or invalid token")
+	errForbidden    = errors.New("rpc registry: permission denied")
+)
+
+// 开启认证 tokens为token - 权限 tokens为空时关闭认证 需要在开始处理请求之前调用
+func (r *GeeRegistry) SetTokens(tokens map[string]Credential) {
+	creds := make([]tokenCredential, 0, len(tokens))
+	for token, cred := range tokens {
+		creds = append(creds, tokenCredential{token: token, cred: cred})
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tokens = creds
+}
+
+// 检查token是否有namespace中的权限perm 未开启认证时总是允许
+func (r *GeeRegistry) authorize(token, namespace string, perm Permission) error {
+	cred, enabled := r.credential(token)
+	if !enabled {
+		return nil
+	}
+	if cred == nil {
+		return errUnauthorized
+	}
+	if !cred.allow(namespace, perm) {
+		return errForbidden
+	}
+	return nil
+}
+
+// 查找token对应的权限 enabled为是否开启了认证 逐个比较所有token 避免通过比较时间猜测token
+func (r *GeeRegistry) credential(token string) (cred *Credential, enabled bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.tokens) == 0 {
+		return nil, false
+	}
+	for i := range r.tokens {
+		if subtle.ConstantTimeCompare([]byte(r.tokens[i].token), []byte(token)) == 1 && token != "" {
+			c := r.tokens[i].cred
+			cred = &c
+		}
+	}
+	return cred, true
+}
+
+// 从HTTP请求中获取token Bearer token或者Basic认证的密码 用户名被忽略
+func requestToken(req *http.Request) string {
+	if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+	if _, password, ok := req.BasicAuth(); ok {
+		return password
+	}
+	return ""
+}
+
+// 检查HTTP请求的权限 没有权限时写入401或403并返回false
+func (r *GeeRegistry) authorizeHTTP(w http.ResponseWriter, req *http.Request, namespace string, perm Permission) bool {
+	switch err := r.authorize(requestToken(req), namespace, perm); err {
+	case nil:
+		return true
+	case errUnauthorized:
+		w.Header().Set("WWW-Authenticate", `Basic realm="geerpc registry"`)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+	default:
+		http.Error(w, err.Error(), http.StatusForbidden)
+	}
+	return false
+}
+
+// 去掉注册中心地址中的token 用于日志 rawURL可以是以逗号分隔的多个地址
+func RedactToken(rawURL string) string {
+	urls := strings.Split(rawURL, ",")
+	for i, raw := range urls {
+		u, err := url.Parse(raw)
+		if err != nil || u.User == nil {
+			continue
+		}
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), "xxxxx")
+		} else {
+			u.User = url.User("xxxxx")
+		}
+		urls[i] = u.String()
+	}
+	return strings.Join(urls, ",")
+}
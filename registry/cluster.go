@@ -0,0 +1,303 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+/* *****************************************************
+集群模式：每个节点都可以接收心跳和注销，节点之间定期（以及服务列表
+变化时）把自己的全部状态推送给其他节点，接收方按lamport版本合并：
+1. 实例的元数据和注销带有lamport版本 版本高的覆盖版本低的 版本相同时按节点ID决定
+2. 心跳只刷新存活时间 同步时发送距上次心跳的时长 接收方取较新的一个 不受节点间时钟偏差影响
+3. 注销以墓碑的形式同步 墓碑保留一段时间后删除
+4. 实例过期由每个节点各自判断 不需要同步
+5. 运维人员的覆盖配置同样按lamport版本合并 取消覆盖时保留空的覆盖配置以便同步 与墓碑一样过期后删除
+6. 只有集群模式的节点接收同步 未开启认证时只接收来自peers所在主机的同步 开启认证时需要AdminPermission
+***************************************************** */
+
+const (
+	defaultSyncInterval = time.Second
+	minTombstoneTTL     = time.Minute
+)
+
+type tombstone struct {
+	namespace string
+	addr      string
+	version   uint64
+	node      string
+	at        time.Time
+}
+
+// 同步的一个实例或墓碑
+type replicaEntry struct {
+	Item    ServerItem    `json:"item"`
+	Version uint64        `json:"version"`
+	Node    string        `json:"node"`
+	Deleted bool          `json:"deleted,omitempty"`
+	Age     time.Duration `json:"age,omitempty"` // 距上次心跳的时长
+}
+
+// 同步的一个覆盖配置
+type overrideEntry struct {
+	Override Override `json:"override"`
+	Version  uint64   `json:"version"`
+	Node     string   `json:"node"`
+}
+
+type replicaState struct {
+	Node      string          `json:"node"`
+	Clock     uint64          `json:"clock"`
+	Entries   []replicaEntry  `json:"entries"`
+	Overrides []overrideEntry `json:"overrides,omitempty"`
+}
+
+// (v1, n1)是否比(v2, n2)新
+func newer(v1 uint64, n1 string, v2 uint64, n2 string) bool {
+	return v1 > v2 || (v1 == v2 && n1 > n2)
+}
+
+type replicator struct {
+	peers     []string
+	peerHosts map[string]bool // peers所在主机的IP 未开启认证时只接收来自这些主机的同步
+	interval  time.Duration
+	client    *http.Client
+	notify    chan struct{}
+	stop      chan struct{}
+	stopOnce  sync.Once
+	done      chan struct{}
+}
+
+// 非阻塞地通知立即同步
+func (c *replicator) trigger() {
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+}
+
+// 解析peers所在主机的IP 使用域名的peer在调用SetPeers时解析
+func resolvePeers(peers []string) map[string]bool {
+	hosts := make(map[string]bool)
+	for _, peer := range peers {
+		u, err := url.Parse(peer)
+		if err != nil || u.Hostname() == "" {
+			continue
+		}
+		if ip := net.ParseIP(u.Hostname()); ip != nil {
+			hosts[ip.String()] = true
+			continue
+		}
+		ips, _ := net.LookupHost(u.Hostname())
+		for _, ip := range ips {
+			hosts[net.ParseIP(ip).String()] = true
+		}
+	}
+	return hosts
+}
+
+// 请求是否来自peers所在的主机
+func (c *replicator) fromPeer(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && c.peerHosts[ip.String()]
+}
+
+// 以集群模式运行 node为本节点的ID（一般是本节点的注册中心地址） peers为其他节点的注册中心地址
+// 其他节点开启了认证时 peers中需要带上有所有命名空间AdminPermission的token 见auth.go
+// 未开启认证时只接收来自peers所在主机的同步
+// 每隔interval以及服务列表变化时向其他节点推送状态 interval为0时默认1s 需要在开始处理请求之前调用
+func (r *GeeRegistry) SetPeers(node string, peers []string, interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultSyncInterval
+	}
+	c := &replicator{
+		peers:     peers,
+		peerHosts: resolvePeers(peers),
+		interval:  interval,
+		client:    &http.Client{Timeout: interval * 5},
+		notify:    make(chan struct{}, 1),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	r.mu.Lock()
+	r.node = node
+	for _, item := range r.servers { // 从存储恢复的实例和覆盖配置属于本节点
+		item.node = node
+	}
+	for _, o := range r.overrides {
+		o.node = node
+	}
+	r.cluster = c
+	r.mu.Unlock()
+	go r.replicate(c)
+}
+
+func (r *GeeRegistry) replicate(c *replicator) {
+	defer close(c.done)
+	t := time.NewTicker(c.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-t.C:
+		case <-c.notify:
+		}
+		body, _ := json.Marshal(r.replicaState())
+		for _, peer := range c.peers {
+			if err := c.push(peer, body); err != nil {
+				r.logger.Printf("rpc registry: replicate to %s err: %v", RedactToken(peer), err)
+			}
+		}
+	}
+}
+
+func (c *replicator) push(peer string, body []byte) error {
+	req, err := http.NewRequest("PUT", peer, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return doRequestWith(c.client, req)
+}
+
+// 本节点的全部状态 同时清理过期的墓碑
+func (r *GeeRegistry) replicaState() *replicaState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	state := &replicaState{Node: r.node, Clock: r.clock}
+	for _, s := range r.servers {
+		state.Entries = append(state.Entries, replicaEntry{Item: *s, Version: s.version, Node: s.node, Age: now.Sub(s.start)})
+	}
+	ttl := r.timeout
+	if ttl < minTombstoneTTL {
+		ttl = minTombstoneTTL
+	}
+	for key, t := range r.tombstones {
+		if now.Sub(t.at) >= ttl {
+			delete(r.tombstones, key)
+			continue
+		}
+		state.Entries = append(state.Entries, replicaEntry{
+			Item:    ServerItem{Namespace: t.namespace, Addr: t.addr},
+			Version: t.version,
+			Node:    t.node,
+			Deleted: true,
+		})
+	}
+	for key, o := range r.overrides {
+		if o.empty() && now.Sub(o.at) >= ttl { // 取消覆盖已经同步到其他节点
+			delete(r.overrides, key)
+			continue
+		}
+		state.Overrides = append(state.Overrides, overrideEntry{Override: *o, Version: o.version, Node: o.node})
+	}
+	return state
+}
+
+func (r *GeeRegistry) serveReplicate(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	c, auth := r.cluster, len(r.tokens) > 0
+	r.mu.Unlock()
+	if c == nil {
+		http.Error(w, "rpc registry: not in cluster mode", http.StatusForbidden)
+		return
+	}
+	if !auth && !c.fromPeer(req.RemoteAddr) { // 开启认证时已经检查过token
+		http.Error(w, "rpc registry: replication is only accepted from peers", http.StatusForbidden)
+		return
+	}
+	var state replicaState
+	if err := json.NewDecoder(req.Body).Decode(&state); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	r.merge(&state)
+}
+
+// 合并其他节点的状态
+func (r *GeeRegistry) merge(state *replicaState) {
+	defer r.flushStore()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if state.Clock > r.clock {
+		r.clock = state.Clock
+	}
+	now := time.Now()
+	type change struct {
+		op   string
+		item ServerItem
+	}
+	var changes []change
+	for _, e := range state.Entries {
+		if !e.Deleted && r.timeout > 0 && e.Age >= r.timeout { // 在发送方已经过期
+			continue
+		}
+		key := itemKey(e.Item.Namespace, e.Item.Addr)
+		local, alive := r.servers[key]
+		dead, deleted := r.tombstones[key]
+		var isNewer bool
+		switch {
+		case alive:
+			isNewer = newer(e.Version, e.Node, local.version, local.node)
+		case deleted:
+			isNewer = newer(e.Version, e.Node, dead.version, dead.node)
+		default:
+			isNewer = true
+		}
+		start := now.Add(-e.Age)
+		if !isNewer {
+			// 版本相同时只合并存活时间
+			if alive && !e.Deleted && e.Version == local.version && e.Node == local.node && start.After(local.start) {
+				local.start = start
+			}
+			continue
+		}
+		if e.Deleted {
+			r.tombstones[key] = &tombstone{namespace: e.Item.Namespace, addr: e.Item.Addr, version: e.Version, node: e.Node, at: now}
+			if alive {
+				delete(r.servers, key)
+				changes = append(changes, change{opDelete, *local})
+			}
+			continue
+		}
+		item := e.Item
+		item.version, item.node, item.start = e.Version, e.Node, start
+		if alive && start.Before(local.start) {
+			item.start = local.start
+		}
+		r.servers[key] = &item
+		delete(r.tombstones, key)
+		changes = append(changes, change{opPut, item})
+	}
+	var overrides []Override
+	for _, e := range state.Overrides {
+		key := itemKey(e.Override.Namespace, e.Override.Addr)
+		if local, ok := r.overrides[key]; ok && !newer(e.Version, e.Node, local.version, local.node) {
+			continue
+		}
+		o := e.Override
+		o.version, o.node = e.Version, e.Node
+		r.putOverrideLocked(key, &o)
+		overrides = append(overrides, o)
+	}
+	if len(changes) > 0 || len(overrides) > 0 {
+		r.changeLocked()
+		for _, c := range changes {
+			r.persistLocked(c.op, c.item)
+		}
+		for _, o := range overrides {
+			r.persistOverrideLocked(o)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"geerpc"
+	"geerpc/codec"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	retryInitialBackoff = time.Second // 心跳失败后第一次重试前的等待时间
+)
+
+// 心跳的设置
+type HeartbeatOption struct {
+	Server   *geerpc.Server // 不为nil时上报server已注册的服务和支持的编码方式 见HeartbeatInstance
+	Duration time.Duration  // 心跳周期 为0时比注册中心默认的过期时间少1min
+	Logger   geerpc.Logger  // 为nil时使用geerpc.DefaultLogger
+}
+
+// 定时发送心跳的句柄 Stop停止心跳并从注册中心注销实例
+type HeartbeatHandle struct {
+	target     string       // 注册中心的地址 用于日志
+	addr       string       // 实例地址 用于日志
+	deregister func() error // 从注册中心注销实例 HTTP或geerpc协议
+	logger     geerpc.Logger
+	stop       chan struct{}
+	done       chan struct{}
+	stopOnce   sync.Once
+}
+
+// 便于服务启动定时向注册中心发送心跳 默认周期比注册中心设置的过期时间少1min
+// registry中可以带上namespace参数 把实例注册到对应的命名空间
+func Heartbeat(registry, addr string, duration time.Duration) *HeartbeatHandle {
+	return HeartbeatWeight(registry, addr, 0, duration)
+}
+
+// 与Heartbeat相同 同时向注册中心上报实例的权重
+func HeartbeatWeight(registry, addr string, weight int, duration time.Duration) *HeartbeatHandle {
+	return HeartbeatInstance(registry, ServerItem{Addr: addr, Weight: weight}, nil, duration)
+}
+
+// 与Heartbeat相同 同时上报server已注册的服务 每次心跳重新获取 之后注册的服务也会被上报
+// server为nil时使用geerpc.DefaultServer
+func HeartbeatServer(registry, addr string, server *geerpc.Server, duration time.Duration) *HeartbeatHandle {
+	if server == nil {
+		server = geerpc.DefaultServer
+	}
+	return HeartbeatInstance(registry, ServerItem{Addr: addr}, server, duration)
+}
+
+// 上报实例及其元数据 server不为nil且item中没有指定服务或编码方式时
+// 使用server已注册的服务和支持的编码方式
+// 第一次心跳同步发送 之后每隔duration发送一次 失败时按指数退避重试 直到调用Stop
+func HeartbeatInstance(registry string, item ServerItem, server *geerpc.Server, duration time.Duration) *HeartbeatHandle {
+	return HeartbeatWithOption(registry, item, &HeartbeatOption{Server: server, Duration: duration})
+}
+
+// 与HeartbeatInstance相同 opt为nil时使用默认设置 日志输出到opt.Logger
+func HeartbeatWithOption(registry string, item ServerItem, opt *HeartbeatOption) *HeartbeatHandle {
+	return startHeartbeat(RedactToken(registry), item, opt, func(item ServerItem) error {
+		return sendHeartbeat(registry, item)
+	}, func() error {
+		return Deregister(registry, item.Namespace, item.Addr)
+	})
+}
+
+// 使用send发送心跳 Stop时调用deregister注销实例 target只用于日志
+func startHeartbeat(target string, item ServerItem, opt *HeartbeatOption, send func(ServerItem) error, deregister func() error) *HeartbeatHandle {
+	var o HeartbeatOption
+	if opt != nil {
+		o = *opt
+	}
+	if o.Duration == 0 {
+		o.Duration = defaultTimeout - time.Duration(1)*time.Minute
+	}
+	if o.Logger == nil {
+		o.Logger = geerpc.DefaultLogger
+	}
+	h := &HeartbeatHandle{
+		target:     target,
+		addr:       item.Addr,
+		deregister: deregister,
+		logger:     o.Logger,
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	server := o.Server
+	sendItem := func() error {
+		item := item
+		if server != nil && len(item.Services) == 0 {
+			item.Services = server.Services()
+		}
+		if server != nil && len(item.Codecs) == 0 {
+			for t := range codec.NewCodecFuncMap {
+				item.Codecs = append(item.Codecs, string(t))
+			}
+		}
+		h.logger.Printf("%s send heart beat to registry %s", item.Addr, target)
+		err := send(item)
+		if err != nil {
+			h.logger.Printf("rpc server: heat beat err: %v", err)
+		}
+		return err
+	}
+	err := sendItem()
+	go h.loop(sendItem, err, o.Duration)
+	return h
+}
+
+func (h *HeartbeatHandle) loop(send func() error, err error, duration time.Duration) {
+	defer close(h.done)
+	attempt := 0
+	for {
+		wait := duration
+		if err != nil { // 失败后尽快重试 等待时间不超过心跳周期
+			wait = geerpc.Backoff(retryInitialBackoff, duration, 2, 0.2, attempt)
+			attempt++
+		} else {
+			attempt = 0
+		}
+		select {
+		case <-h.stop:
+			return
+		case <-time.After(wait):
+		}
+		err = send()
+	}
+}
+
+// 停止心跳并从注册中心注销实例 可以多次调用
+func (h *HeartbeatHandle) Stop() error {
+	stopped := false
+	h.stopOnce.Do(func() {
+		close(h.stop)
+		stopped = true
+	})
+	<-h.done
+	if !stopped {
+		return nil
+	}
+	h.logger.Printf("%s deregister from registry %s", h.addr, h.target)
+	err := h.deregister()
+	if err != nil {
+		h.logger.Printf("rpc server: deregister err: %v", err)
+	}
+	return err
+}
+
+func sendHeartbeat(registry string, item ServerItem) error {
+	body, _ := json.Marshal(&item)
+	return tryRegistries(registry, func(u string) (*http.Request, error) {
+		req, err := http.NewRequest("POST", u, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Geerpc-Server", item.Addr)
+		return req, nil
+	})
+}
+
+// 从注册中心注销实例 namespace为空时使用registry中的namespace参数
+func Deregister(registry, namespace, addr string) error {
+	return tryRegistries(registry, func(u string) (*http.Request, error) {
+		if namespace != "" {
+			if parsed, err := url.Parse(u); err == nil {
+				q := parsed.Query()
+				q.Set("namespace", namespace)
+				parsed.RawQuery = q.Encode()
+				u = parsed.String()
+			}
+		}
+		req, err := http.NewRequest("DELETE", u, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("X-Geerpc-Server", addr)
+		return req, nil
+	})
+}
+
+// registry可以是以逗号分隔的多个注册中心地址（集群中的多个节点） 依次尝试直到有一个成功
+func tryRegistries(registry string, newRequest func(u string) (*http.Request, error)) error {
+	var err error
+	for _, u := range strings.Split(registry, ",") {
+		var req *http.Request
+		if req, err = newRequest(strings.TrimSpace(u)); err != nil {
+			continue
+		}
+		if err = doRequest(req); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+var httpClient = &http.Client{Timeout: time.Second * 10}
+
+func doRequest(req *http.Request) error {
+	return doRequestWith(httpClient, req)
+}
+
+func doRequestWith(client *http.Client, req *http.Request) error {
+	// http.Client.Do：发现HTTP请求并返回一个HTTP响应
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	// 注销时实例已经过期会返回404 不算错误 其他请求的404说明地址错误 需要尝试下一个注册中心
+	if resp.StatusCode != http.StatusOK && !(req.Method == "DELETE" && resp.StatusCode == http.StatusNotFound) {
+		return fmt.Errorf("rpc registry: unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,238 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"geerpc"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* *****************************************************
+主动探测：注册中心定期探测每个已注册的实例，连续探测失败的实例被标记为
+不健康，查询时不再返回，直到连续探测成功后恢复。心跳在单独的goroutine中
+发送，进程卡住时心跳可能仍然正常，探测可以发现这种情况：
+1. TCPProbe 只检查能否建立TCP连接
+2. DialProbe 建立连接并完成Option协商
+3. RPCProbe 完成协商后调用指定的服务方法 例如一个ping方法
+健康状态只保存在本节点 不持久化也不在集群中同步 每个节点各自探测
+***************************************************** */
+
+// 探测一个实例是否健康 rpcAddr为protocol@addr格式 返回nil表示健康
+type Probe func(ctx context.Context, rpcAddr string) error
+
+type ProbeOption struct {
+	Interval         time.Duration // 探测的间隔 默认10s
+	Timeout          time.Duration // 每次探测的超时时间 默认1s
+	Probe            Probe         // 探测方法 默认为DialProbe(nil)
+	FailureThreshold int           // 连续失败达到该次数时标记为不健康 默认1
+	SuccessThreshold int           // 不健康的实例连续成功达到该次数时恢复 默认1
+}
+
+const (
+	defaultProbeInterval = time.Second * 10
+	defaultProbeTimeout  = time.Second
+)
+
+type probeState struct {
+	unhealthy bool
+	failures  int // 连续失败次数
+	successes int // 不健康时连续成功的次数
+}
+
+type prober struct {
+	opt      ProbeOption
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// 开启主动探测 opt为nil时使用默认值 需要在开始处理请求之前调用 Close时停止
+func (r *GeeRegistry) SetProbe(opt *ProbeOption) {
+	var o ProbeOption
+	if opt != nil {
+		o = *opt
+	}
+	if o.Interval <= 0 {
+		o.Interval = defaultProbeInterval
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = defaultProbeTimeout
+	}
+	if o.Probe == nil {
+		o.Probe = DialProbe(nil)
+	}
+	if o.FailureThreshold <= 0 {
+		o.FailureThreshold = 1
+	}
+	if o.SuccessThreshold <= 0 {
+		o.SuccessThreshold = 1
+	}
+	p := &prober{opt: o, stop: make(chan struct{}), done: make(chan struct{})}
+	r.mu.Lock()
+	r.prober = p
+	r.mu.Unlock()
+	go r.probeLoop(p)
+}
+
+// 只检查能否建立TCP连接 http协议的实例同样使用TCP
+func TCPProbe() Probe {
+	return func(ctx context.Context, rpcAddr string) error {
+		network, addr, err := splitAddr(rpcAddr)
+		if err != nil {
+			return err
+		}
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, network, addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
+
+// 建立连接并完成Option协商
+func DialProbe(opt *geerpc.Option) Probe {
+	return func(ctx context.Context, rpcAddr string) error {
+		client, err := dialContext(ctx, rpcAddr, opt)
+		if err != nil {
+			return err
+		}
+		return client.Close()
+	}
+}
+
+// 调用指定的服务方法进行探测 reply只用于确定返回值的类型 服务方法返回错误也视为不健康
+// reply不是nil或指针时返回错误
+func RPCProbe(serviceMethod string, args, reply interface{}, opt *geerpc.Option) (Probe, error) {
+	if reply != nil && reflect.TypeOf(reply).Kind() != reflect.Ptr {
+		return nil, fmt.Errorf("rpc registry: probe reply must be a pointer, got %T", reply)
+	}
+	return func(ctx context.Context, rpcAddr string) error {
+		client, err := dialContext(ctx, rpcAddr, opt)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = client.Close() }()
+		var clonedReply interface{}
+		if reply != nil {
+			clonedReply = reflect.New(reflect.ValueOf(reply).Elem().Type()).Interface()
+		}
+		return client.Call(ctx, serviceMethod, args, clonedReply)
+	}, nil
+}
+
+func splitAddr(rpcAddr string) (network, addr string, err error) {
+	parts := strings.Split(rpcAddr, "@")
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("rpc registry: wrong format '%s', expect protocol@addr", rpcAddr)
+	}
+	if parts[0] == "http" {
+		return "tcp", parts[1], nil
+	}
+	return parts[0], parts[1], nil
+}
+
+// 建立连接的时间不超过ctx的deadline
+func dialContext(ctx context.Context, rpcAddr string, opt *geerpc.Option) (*geerpc.Client, error) {
+	o := *geerpc.DefaultOption
+	if opt != nil {
+		o = *opt
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		if d := time.Until(deadline); o.ConnectTimeout == 0 || d < o.ConnectTimeout {
+			o.ConnectTimeout = d
+		}
+	}
+	if o.ConnectTimeout <= 0 {
+		return nil, context.DeadlineExceeded
+	}
+	return geerpc.XDial(rpcAddr, &o)
+}
+
+func (r *GeeRegistry) probeLoop(p *prober) {
+	defer close(p.done)
+	t := time.NewTicker(p.opt.Interval)
+	defer t.Stop()
+	for {
+		r.probeAll(p)
+		select {
+		case <-p.stop:
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// 并发探测所有实例 健康状态变化时更新服务列表的版本号 唤醒长轮询
+func (r *GeeRegistry) probeAll(p *prober) {
+	r.mu.Lock()
+	targets := make(map[string]string, len(r.servers)) // 命名空间/地址 - 地址
+	for key, s := range r.servers {
+		targets[key] = s.Addr
+	}
+	for key := range r.health { // 已经下线的实例
+		if _, ok := targets[key]; !ok {
+			delete(r.health, key)
+		}
+	}
+	r.mu.Unlock()
+
+	results := make(map[string]error, len(targets))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for key, addr := range targets {
+		wg.Add(1)
+		go func(key, addr string) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), p.opt.Timeout)
+			defer cancel()
+			err := p.opt.Probe(ctx, addr)
+			mu.Lock()
+			results[key] = err
+			mu.Unlock()
+		}(key, addr)
+	}
+	wg.Wait()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	changed := false
+	for key, err := range results {
+		if _, ok := r.servers[key]; !ok { // 探测期间被注销
+			continue
+		}
+		h, ok := r.health[key]
+		if !ok {
+			h = &probeState{}
+			r.health[key] = h
+		}
+		if err != nil {
+			h.successes = 0
+			if h.failures++; !h.unhealthy && h.failures >= p.opt.FailureThreshold {
+				h.unhealthy, changed = true, true
+				r.logger.Printf("rpc registry: health check of %s failed: %v", key, err)
+			}
+			continue
+		}
+		h.failures = 0
+		if h.unhealthy {
+			if h.successes++; h.successes >= p.opt.SuccessThreshold {
+				h.unhealthy, h.successes, changed = false, 0, true
+				r.logger.Printf("rpc registry: %s is healthy again", key)
+			}
+		}
+	}
+	if changed {
+		r.changeLocked()
+	}
+}
+
+// 实例是否被探测为不健康 需要持有r.mu
+func (r *GeeRegistry) unhealthyLocked(key string) bool {
+	h, ok := r.health[key]
+	return ok && h.unhealthy
+}
@@ -1,9 +1,13 @@
 package registry
 
 import (
-	"log"
+	"context"
+	"encoding/json"
+	"errors"
+	"geerpc"
 	"net/http"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -14,109 +18,423 @@ import (
 1. 服务注册
 2. 接收服务器实例的心跳包
 3. 查询可用服务并返回
+4. 长轮询：GET带上index参数时 服务列表的版本号与index不同才返回
+5. 实例属于一个命名空间 可以提供多个服务 查询时按命名空间和服务名过滤
+   命名空间和服务名通过URL参数namespace、service指定 未指定命名空间时为默认的空命名空间
+6. 实例可以携带版本、可用区、编码方式、标签等元数据 GET带上format=json时以JSON返回
+   可以通过URL参数tag（可以有多个 需全部满足）、zone、version过滤
+7. DELETE注销服务实例 服务关闭时不必等到超时
+8. 可选的磁盘存储 重启后恢复服务列表 见store.go
+9. 集群模式 多个节点之间同步服务列表 见cluster.go
+10. 可选的主动探测 不健康的实例不在查询结果中返回 见probe.go
+11. 管理页面 查看所有实例 禁用实例或覆盖实例的权重 见admin.go
+12. 除了HTTP 还可以作为geerpc服务提供以上的注册、心跳、注销、查询和长轮询 见rpc.go
+13. 可选的认证 token决定可以访问的命名空间和读写权限 见auth.go
 ***************************************************** */
 type GeeRegistry struct {
 	timeout time.Duration // 服务超时时间 默认为5分钟
 	mu      sync.Mutex
-	servers map[string]*ServerItem
+	servers map[string]*ServerItem // 命名空间/地址 - 实例
+	index   uint64                 // 服务列表的版本号 每次变化加1
+	changed chan struct{}          // 服务列表变化时关闭并替换 用于唤醒长轮询
+	store   *Store                 // 为nil时只保存在内存中
+	logger  geerpc.Logger
+
+	// 持久化 见store.go
+	pending []storeRecord // 等待写入store的变化
+	storeMu sync.Mutex    // 保证变化按顺序写入store
+
+	// 集群模式 见cluster.go
+	node       string                // 本节点的ID 非集群模式为空
+	clock      uint64                // lamport时钟
+	tombstones map[string]*tombstone // 已注销的实例 用于向其他节点同步注销
+	cluster    *replicator
+
+	// 主动探测 见probe.go
+	prober *prober
+	health map[string]*probeState // 命名空间/地址 - 探测状态
+
+	overrides map[string]*Override // 命名空间/地址 - 运维人员的覆盖配置 见admin.go
+	tokens    []tokenCredential    // 为空时不开启认证 见auth.go
 }
 
 type ServerItem struct { // 服务实例
-	Addr  string
-	start time.Time // 用于检查服务是否超时
+	Addr      string    `json:"addr"`
+	Namespace string    `json:"namespace,omitempty"`
+	Services  []string  `json:"services,omitempty"` // 实例提供的服务名 已排序 为空表示未上报
+	Weight    int       `json:"weight,omitempty"`   // 用于加权负载均衡 0表示未设置 客户端按1处理
+	Version   string    `json:"version,omitempty"`  // 实例的版本
+	Zone      string    `json:"zone,omitempty"`     // 实例所在的可用区
+	Codecs    []string  `json:"codecs,omitempty"`   // 支持的编码方式 例如application/gob
+	Tags      []string  `json:"tags,omitempty"`     // 标签 例如canary
+	start     time.Time // 用于检查服务是否超时
+	version   uint64    // 集群模式下元数据的lamport版本
+	node      string    // 修改元数据的节点 版本相同时用于决定先后
+}
+
+// 是否带有标签tag
+func (s *ServerItem) HasTag(tag string) bool {
+	return contains(s.Tags, tag)
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// 查询条件 为空的条件不过滤
+type query struct {
+	namespace string
+	service   string
+	zone      string
+	version   string
+	tags      []string // 需要带有所有的标签
+}
+
+func (q query) match(s *ServerItem) bool {
+	if s.Namespace != q.namespace {
+		return false
+	}
+	if (q.service != "" && !contains(s.Services, q.service)) ||
+		(q.zone != "" && s.Zone != q.zone) || (q.version != "" && s.Version != q.version) {
+		return false
+	}
+	for _, tag := range q.tags {
+		if !s.HasTag(tag) {
+			return false
+		}
+	}
+	return true
+}
+
+func itemKey(namespace, addr string) string {
+	return namespace + "/" + addr
 }
 
 const (
 	defaultPath    = "/_geerpc_/registry"
+	adminSuffix    = "/admin" // 管理页面的路径为注册中心路径加上adminSuffix
 	defaultTimeout = time.Minute * 5
+	defaultWait    = time.Second * 30 // 长轮询的默认等待时间
+	maxWait        = time.Minute * 5
 )
 
 func New(timeout time.Duration) *GeeRegistry {
 	return &GeeRegistry{
-		servers: make(map[string]*ServerItem),
-		timeout: timeout,
+		servers:    make(map[string]*ServerItem),
+		tombstones: make(map[string]*tombstone),
+		health:     make(map[string]*probeState),
+		overrides:  make(map[string]*Override),
+		changed:    make(chan struct{}),
+		timeout:    timeout,
+		logger:     geerpc.DefaultLogger,
+	}
+}
+
+// 设置注册中心的日志输出 nil表示丢弃所有日志
+func (r *GeeRegistry) SetLogger(logger geerpc.Logger) {
+	if logger == nil {
+		logger = geerpc.NopLogger
 	}
+	r.logger = logger
+}
+
+// 停止向其他节点同步和主动探测
+func (r *GeeRegistry) Close() error {
+	r.mu.Lock()
+	c, p := r.cluster, r.prober
+	r.mu.Unlock()
+	if c != nil {
+		c.stopOnce.Do(func() { close(c.stop) })
+		<-c.done
+	}
+	if p != nil {
+		p.stopOnce.Do(func() { close(p.stop) })
+		<-p.done
+	}
+	return nil
 }
 
 var DefaultGeeRegistry = New(defaultTimeout)
 
-func (r *GeeRegistry) putServer(addr string) {
+// 添加实例或刷新实例的存活时间 返回是否为新注册的实例
+func (r *GeeRegistry) putServer(item ServerItem) bool {
+	defer r.flushStore() // 释放r.mu之后再写磁盘
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	s := r.servers[addr]
-	if s == nil {
-		r.servers[addr] = &ServerItem{Addr: addr, start: time.Now()}
+	sort.Strings(item.Services)
+	sort.Strings(item.Codecs)
+	sort.Strings(item.Tags)
+	item.start = time.Now()
+	key := itemKey(item.Namespace, item.Addr)
+	s := r.servers[key]
+	if s == nil || !sameMeta(s, &item) { // 心跳可以更新元数据
+		r.clock++
+		item.version, item.node = r.clock, r.node
+		r.servers[key] = &item
+		delete(r.tombstones, key)
+		r.changeLocked()
+		r.persistLocked(opPut, item)
 	} else {
-		s.start = time.Now()
+		s.start = item.start
 	}
+	return s == nil
 }
 
-func (r *GeeRegistry) aliveServers() []string {
+// 注销实例 返回实例是否存在
+func (r *GeeRegistry) removeServer(namespace, addr string) bool {
+	defer r.flushStore()
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	var alive []string
-	for addr, s := range r.servers {
+	key := itemKey(namespace, addr)
+	if r.cluster != nil { // 实例可能只在其他节点上 同样需要同步注销
+		r.clock++
+		r.tombstones[key] = &tombstone{namespace: namespace, addr: addr, version: r.clock, node: r.node, at: time.Now()}
+	}
+	s, ok := r.servers[key]
+	if !ok {
+		return false
+	}
+	delete(r.servers, key)
+	delete(r.health, key)
+	r.changeLocked()
+	r.persistLocked(opDelete, *s)
+	r.logger.Printf("rpc registry: deregister %s", addr)
+	return true
+}
+
+func sameMeta(a, b *ServerItem) bool {
+	return a.Weight == b.Weight && a.Version == b.Version && a.Zone == b.Zone &&
+		equalStrings(a.Services, b.Services) && equalStrings(a.Codecs, b.Codecs) && equalStrings(a.Tags, b.Tags)
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// 服务列表发生变化 需要持有r.mu
+func (r *GeeRegistry) changeLocked() {
+	r.index++
+	close(r.changed)
+	r.changed = make(chan struct{})
+	if r.cluster != nil {
+		r.cluster.trigger()
+	}
+}
+
+// 返回满足查询条件的可用服务实例的副本、当前版本号、版本变化时关闭的chan以及下一个实例过期的时间
+func (r *GeeRegistry) snapshot(q query) (alive []ServerItem, index uint64, changed <-chan struct{}, nextExpiry time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	removed := 0
+	for key, s := range r.servers {
 		// r.timeout = 0 表示不限制服务超时时间
-		if r.timeout == 0 || s.start.Add(r.timeout).After(time.Now()) {
-			alive = append(alive, addr)
+		if r.timeout == 0 || s.start.Add(r.timeout).After(now) {
+			if !q.match(s) || r.unhealthyLocked(key) { // 不健康的实例暂不返回 但不删除
+				continue
+			}
+			item := *s
+			if r.applyOverrideLocked(key, &item) { // 被禁用的实例不返回
+				continue
+			}
+			alive = append(alive, item)
+			if expiry := s.start.Add(r.timeout); r.timeout > 0 && (nextExpiry.IsZero() || expiry.Before(nextExpiry)) {
+				nextExpiry = expiry
+			}
 		} else {
-			delete(r.servers, addr)
+			delete(r.servers, key)
+			delete(r.health, key)
+			removed++
+		}
+	}
+	if removed > 0 { // 读取时不写磁盘 重启后过期的实例会在grace之后再次过期
+		r.changeLocked()
+	}
+	// 这里排序是为了让客户端实现有效的负载均衡 比如轮询
+	sort.Slice(alive, func(i, j int) bool { return alive[i].Addr < alive[j].Addr })
+	return alive, r.index, r.changed, nextExpiry
+}
+
+// 版本号与index不同时立即返回 否则等待服务列表变化、超过wait或ctx结束
+// 实例过期是在读取时才发现的 所以等待时也会在下一个实例过期时醒来检查
+// 版本号是整个注册中心的 其他服务的变化也会让长轮询返回 客户端得到相同的列表后继续轮询即可
+func (r *GeeRegistry) watch(ctx context.Context, q query, index uint64, wait time.Duration) ([]ServerItem, uint64) {
+	deadline := time.NewTimer(wait)
+	defer deadline.Stop()
+	for {
+		alive, cur, changed, nextExpiry := r.snapshot(q)
+		if cur != index { // 注册中心重启后版本号会变小 同样立即返回
+			return alive, cur
+		}
+		var expiry <-chan time.Time
+		var t *time.Timer
+		if !nextExpiry.IsZero() {
+			t = time.NewTimer(time.Until(nextExpiry))
+			expiry = t.C
+		}
+		done := false
+		select {
+		case <-changed:
+		case <-expiry:
+		case <-deadline.C:
+			done = true
+		case <-ctx.Done():
+			done = true
+		}
+		if t != nil {
+			t.Stop()
+		}
+		if done {
+			return alive, cur
 		}
 	}
-	sort.Strings(alive) // 这里排序是为了让客户端实现有效的负载均衡 比如轮询
-	return alive
 }
 
 func (r *GeeRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	switch req.Method {
 	case "GET": // GET返回所有可用的服务实例列表 承载在HTTP Header中 —— X-Geerpc-Servers
-		w.Header().Set("X-Geerpc-Servers", strings.Join(r.aliveServers(), ","))
-	case "POST": // 添加服务实例或发送心跳 承载在HTTP Header中 —— X-Geerpc-Server
+		// 实例的权重按相同顺序承载在 X-Geerpc-Weights 中 服务列表的版本号承载在 X-Geerpc-Index 中
+		// 带上index参数时为长轮询 版本号与index不同或等待超过wait参数（默认30s）后返回
+		// 带上format=json参数或Accept为application/json时 以JSON返回实例及其元数据
+		if !r.authorizeHTTP(w, req, req.URL.Query().Get("namespace"), ReadPermission) {
+			return
+		}
+		alive, index := r.get(req)
+		if req.URL.Query().Get("format") == "json" || strings.Contains(req.Header.Get("Accept"), "application/json") {
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(&QueryResult{Index: index, Servers: alive})
+			return
+		}
+		addrs := make([]string, 0, len(alive))
+		weights := make([]string, 0, len(alive))
+		for _, s := range alive {
+			addrs = append(addrs, s.Addr)
+			weights = append(weights, strconv.Itoa(s.Weight))
+		}
+		w.Header().Set("X-Geerpc-Servers", strings.Join(addrs, ","))
+		w.Header().Set("X-Geerpc-Weights", strings.Join(weights, ","))
+		w.Header().Set("X-Geerpc-Index", strconv.FormatUint(index, 10))
+	case "POST": // 添加服务实例或发送心跳 承载在HTTP Header中 —— X-Geerpc-Server 权重为可选的 X-Geerpc-Weight
+		// 实例提供的服务名为可选的 X-Geerpc-Services 以逗号分隔
+		// Content-Type为application/json时 请求体为包含元数据的ServerItem
+		item, err := parseItem(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !r.authorizeHTTP(w, req, item.Namespace, WritePermission) {
+			return
+		}
+		r.putServer(item)
+	case "PUT": // 集群中其他节点同步的状态
+		if !r.authorizeHTTP(w, req, AllNamespaces, AdminPermission) {
+			return
+		}
+		r.serveReplicate(w, req)
+	case "DELETE": // 注销服务实例 地址承载在 X-Geerpc-Server 中 命名空间为URL参数namespace
 		addr := req.Header.Get("X-Geerpc-Server")
 		if addr == "" {
-			w.WriteHeader(http.StatusInternalServerError)
+			http.Error(w, "rpc registry: missing server address", http.StatusInternalServerError)
 			return
 		}
-		r.putServer(addr)
+		namespace := req.URL.Query().Get("namespace")
+		if !r.authorizeHTTP(w, req, namespace, WritePermission) {
+			return
+		}
+		if !r.removeServer(namespace, addr) {
+			w.WriteHeader(http.StatusNotFound)
+		}
 	default:
 		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
 }
 
-func (r *GeeRegistry) HandleHTTP(regisrtyPath string) {
-	http.Handle(regisrtyPath, r)
-	log.Println("rpc registry path: ", regisrtyPath)
+// GET以JSON返回的查询结果
+type QueryResult struct {
+	Index   uint64       `json:"index"` // 服务列表的版本号 用于长轮询
+	Servers []ServerItem `json:"servers"`
 }
 
-func HandleHTTP() {
-	DefaultGeeRegistry.HandleHTTP(defaultPath)
+// 从心跳请求中解析实例 URL参数namespace在请求体没有指定命名空间时使用
+func parseItem(req *http.Request) (ServerItem, error) {
+	var item ServerItem
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(req.Body).Decode(&item); err != nil {
+			return item, err
+		}
+	} else {
+		item.Addr = req.Header.Get("X-Geerpc-Server")
+		item.Weight, _ = strconv.Atoi(req.Header.Get("X-Geerpc-Weight"))
+		item.Services = splitList(req.Header.Get("X-Geerpc-Services"))
+	}
+	if item.Addr == "" {
+		return item, errors.New("rpc registry: missing server address")
+	}
+	if item.Namespace == "" {
+		item.Namespace = req.URL.Query().Get("namespace")
+	}
+	return item, nil
 }
 
-// 便于服务启动定时向注册中心发送心跳 默认周期比注册中心设置的过期时间少1min
-func Heartbeat(registry, addr string, duration time.Duration) {
-	if duration == 0 {
-		duration = defaultTimeout - time.Duration(1)*time.Minute
-	}
-	var err error
-	err = sendHeartbeat(registry, addr)
-	go func() {
-		t := time.NewTicker(duration) // 定时计时器
-		for err == nil {
-			<-t.C
-			err = sendHeartbeat(registry, addr)
+// 以逗号分隔的列表 去掉空白项
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
 		}
-	}()
+	}
+	return list
 }
 
-func sendHeartbeat(registry, addr string) error {
-	log.Println(addr, "send heart beat to registry", registry)
-	httpClient := &http.Client{}
-	req, _ := http.NewRequest("POST", registry, nil)
-	req.Header.Set("X-Geerpc-Server", addr)
-	// http.Client.Do：发现HTTP请求并返回一个HTTP响应
-	if _, err := httpClient.Do(req); err != nil {
-		log.Println("rpc server: heat beat err:", err)
-		return err
+func (r *GeeRegistry) get(req *http.Request) ([]ServerItem, uint64) {
+	params := req.URL.Query()
+	q := query{
+		namespace: params.Get("namespace"),
+		service:   params.Get("service"),
+		zone:      params.Get("zone"),
+		version:   params.Get("version"),
+		tags:      params["tag"],
 	}
-	return nil
+	index, err := strconv.ParseUint(params.Get("index"), 10, 64)
+	if err != nil {
+		alive, index, _, _ := r.snapshot(q)
+		return alive, index
+	}
+	wait, _ := time.ParseDuration(params.Get("wait"))
+	return r.watch(req.Context(), q, index, clampWait(wait))
+}
+
+// 长轮询的等待时间 不大于0时使用默认值 不超过maxWait
+func clampWait(wait time.Duration) time.Duration {
+	if wait <= 0 {
+		return defaultWait
+	}
+	if wait > maxWait {
+		return maxWait
+	}
+	return wait
+}
+
+func (r *GeeRegistry) HandleHTTP(regisrtyPath string) {
+	http.Handle(regisrtyPath, r)
+	http.Handle(regisrtyPath+adminSuffix, adminHTTP{r})
+	r.logger.Printf("rpc registry path: %s", regisrtyPath)
+}
+
+func HandleHTTP() {
+	DefaultGeeRegistry.HandleHTTP(defaultPath)
 }
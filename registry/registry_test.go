@@ -0,0 +1,624 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"geerpc"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func _assert(condition bool, msg string, v ...interface{}) {
+	if !condition {
+		panic(fmt.Sprintf("assertion failed: "+msg, v...))
+	}
+}
+
+func addrs(items []ServerItem) []string {
+	list := make([]string, 0, len(items))
+	for _, item := range items {
+		list = append(list, item.Addr)
+	}
+	return list
+}
+
+// 以JSON格式查询注册中心
+func queryJSON(rawURL string) (QueryResult, error) {
+	var result QueryResult
+	resp, err := http.Get(rawURL)
+	if err != nil {
+		return result, err
+	}
+	defer resp.Body.Close()
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	return result, err
+}
+
+func TestGeeRegistry_Namespace(t *testing.T) {
+	r := New(0)
+	r.SetLogger(nil)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	var foo Foo
+	server := geerpc.NewServer()
+	server.SetLogger(nil)
+	_ = server.Register(&foo)
+	h := HeartbeatWithOption(ts.URL, ServerItem{Addr: "tcp@a"}, &HeartbeatOption{Server: server, Duration: time.Hour, Logger: geerpc.NopLogger})
+	defer h.Stop()
+	_assert(sendHeartbeat(ts.URL, ServerItem{Addr: "tcp@b"}) == nil, "failed to send heartbeat") // 未上报服务
+	req, _ := http.NewRequest("POST", ts.URL+"?namespace=other", nil)
+	req.Header.Set("X-Geerpc-Server", "tcp@c")
+	req.Header.Set("X-Geerpc-Services", "Foo")
+	resp, err := http.DefaultClient.Do(req)
+	_assert(err == nil, "failed to register: %v", err)
+	_ = resp.Body.Close()
+
+	cases := []struct {
+		query string
+		want  string
+	}{
+		{"service=Foo", "[tcp@a]"},
+		{"service=Bar", "[]"},
+		{"", "[tcp@a tcp@b]"},
+		{"namespace=other&service=Foo", "[tcp@c]"},
+	}
+	for _, c := range cases {
+		result, err := queryJSON(ts.URL + "?format=json&" + c.query)
+		_assert(err == nil && fmt.Sprint(addrs(result.Servers)) == c.want, "query %q: expect %s, got %v %v", c.query, c.want, addrs(result.Servers), err)
+	}
+	resp, err = http.Get(ts.URL + "?service=Foo")
+	_assert(err == nil && resp.Header.Get("X-Geerpc-Servers") == "tcp@a", "unexpected servers header %v", err)
+	_ = resp.Body.Close()
+}
+
+func TestGeeRegistry_Metadata(t *testing.T) {
+	r := New(0)
+	r.SetLogger(nil)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	quiet := &HeartbeatOption{Duration: time.Hour, Logger: geerpc.NopLogger}
+	ha := HeartbeatWithOption(ts.URL, ServerItem{Addr: "tcp@a", Version: "v2", Zone: "z1", Tags: []string{"canary", "ssd"}}, quiet)
+	defer ha.Stop()
+	hb := HeartbeatWithOption(ts.URL, ServerItem{Addr: "tcp@b", Version: "v1", Zone: "z1", Tags: []string{"ssd"}}, quiet)
+	defer hb.Stop()
+
+	result, err := queryJSON(ts.URL + "?format=json&zone=z1")
+	_assert(err == nil && len(result.Servers) == 2 && result.Index == 2, "unexpected query result %+v %v", result, err)
+	a := result.Servers[0]
+	_assert(a.Addr == "tcp@a" && a.Version == "v2" && a.HasTag("canary"), "unexpected instance metadata %+v", a)
+	cases := []struct {
+		query string
+		want  string
+	}{
+		{"tag=canary", "[tcp@a]"},
+		{"tag=ssd&tag=canary", "[tcp@a]"},
+		{"tag=ssd", "[tcp@a tcp@b]"},
+		{"version=v1", "[tcp@b]"},
+		{"zone=z2", "[]"},
+	}
+	for _, c := range cases {
+		result, err := queryJSON(ts.URL + "?format=json&" + c.query)
+		_assert(err == nil && fmt.Sprint(addrs(result.Servers)) == c.want, "query %q: expect %s, got %v %v", c.query, c.want, addrs(result.Servers), err)
+	}
+}
+
+func TestGeeRegistry_HeartbeatStopAndRetry(t *testing.T) {
+	r := New(0)
+	r.SetLogger(nil)
+	var mu sync.Mutex
+	failures := 1 // 第一次心跳失败
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		fail := req.Method == "POST" && failures > 0
+		if fail {
+			failures--
+		}
+		mu.Unlock()
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		r.ServeHTTP(w, req)
+	}))
+	defer ts.Close()
+
+	alive := func() []string {
+		servers, _, _, _ := r.snapshot(query{namespace: "ns"})
+		return addrs(servers)
+	}
+	var buf bytes.Buffer
+	h := HeartbeatWithOption(ts.URL+"?namespace=ns", ServerItem{Addr: "tcp@a"}, &HeartbeatOption{Duration: time.Hour, Logger: log.New(&buf, "", 0)})
+	_assert(len(alive()) == 0, "expect first heartbeat to fail")
+	registered := false
+	for i := 0; i < 30 && !registered; i++ { // 失败后约1s重试
+		time.Sleep(time.Millisecond * 100)
+		registered = len(alive()) == 1
+	}
+	_assert(registered, "expect heartbeat to be retried")
+
+	_assert(h.Stop() == nil, "failed to deregister")
+	_assert(len(alive()) == 0, "expect server to be deregistered, got %v", alive())
+	_assert(h.Stop() == nil, "stop should be idempotent")
+	_assert(strings.Contains(buf.String(), "heat beat err") && strings.Contains(buf.String(), "deregister from registry"), "expect logs to go to the handle's logger, got %q", buf.String())
+
+	// 心跳返回404说明注册中心地址错误 使用下一个注册中心
+	nf := httptest.NewServer(http.NotFoundHandler())
+	defer nf.Close()
+	_assert(sendHeartbeat(nf.URL, ServerItem{Addr: "tcp@b"}) != nil, "expect heartbeat answered by 404 to fail")
+	_assert(sendHeartbeat(nf.URL+","+ts.URL, ServerItem{Addr: "tcp@b"}) == nil, "expect heartbeat to fail over after 404")
+	servers, _, _, _ := r.snapshot(query{})
+	_assert(fmt.Sprint(addrs(servers)) == "[tcp@b]", "expect server to be registered on the next registry, got %v", addrs(servers))
+}
+
+func TestGeeRegistry_Store(t *testing.T) {
+	dir, err := ioutil.TempDir("", "geerpc-registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, _ := OpenStore(dir)
+	r := New(time.Minute)
+	r.SetLogger(geerpc.NopLogger)
+	_assert(r.SetStore(store, 0) == nil, "failed to set store")
+	r.putServer(ServerItem{Addr: "tcp@a", Tags: []string{"canary"}})
+	r.putServer(ServerItem{Addr: "tcp@b"})
+	r.putServer(ServerItem{Addr: "tcp@c", Namespace: "ns"})
+	r.SetOverride(Override{Addr: "tcp@c", Namespace: "ns", Weight: 3})
+	r.removeServer("", "tcp@b")
+	store.compactEvery = 2 // 之后的变化触发快照
+	r.putServer(ServerItem{Addr: "tcp@d"})
+	_, index, _, _ := r.snapshot(query{})
+	_ = store.Close()
+
+	// 日志最后一条记录写了一半
+	f, _ := os.OpenFile(dir+"/"+logFile, os.O_APPEND|os.O_WRONLY, 0644)
+	_, _ = f.WriteString(`{"op":"put","item":{"addr":"tcp@e"`)
+	_ = f.Close()
+
+	store, _ = OpenStore(dir)
+	defer store.Close()
+	r2 := New(time.Minute)
+	r2.SetLogger(geerpc.NopLogger)
+	_assert(r2.SetStore(store, time.Millisecond*100) == nil, "failed to restore")
+	alive, index2, _, _ := r2.snapshot(query{})
+	_assert(fmt.Sprint(addrs(alive)) == "[tcp@a tcp@d]", "unexpected restored servers %v", addrs(alive))
+	_assert(alive[0].HasTag("canary"), "expect metadata to be restored")
+	_assert(index2 > index, "expect index to keep increasing after restore")
+	ns, _, _, _ := r2.snapshot(query{namespace: "ns"})
+	_assert(len(ns) == 1 && ns[0].Weight == 3, "expect server and override in namespace to be restored")
+
+	// 恢复的实例在grace内没有心跳时过期
+	r2.putServer(ServerItem{Addr: "tcp@a", Tags: []string{"canary"}})
+	info, _ := os.Stat(dir + "/" + logFile)
+	time.Sleep(time.Millisecond * 150)
+	alive, _, _, _ = r2.snapshot(query{})
+	_assert(fmt.Sprint(addrs(alive)) == "[tcp@a]", "expect only server with heartbeat to survive, got %v", addrs(alive))
+
+	info2, _ := os.Stat(dir + "/" + logFile)
+	_assert(info.Size() == info2.Size(), "expect expiry found by reads not to be written to the log")
+}
+
+// 等待所有节点上的服务列表满足条件
+func waitNodes(nodes []*GeeRegistry, cond func(alive []string) bool) bool {
+	for deadline := time.Now().Add(time.Second * 2); time.Now().Before(deadline); time.Sleep(time.Millisecond * 10) {
+		ok := true
+		for _, r := range nodes {
+			alive, _, _, _ := r.snapshot(query{})
+			ok = ok && cond(addrs(alive))
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+func TestGeeRegistry_Cluster(t *testing.T) {
+	nodes := make([]*GeeRegistry, 3)
+	urls := make([]string, 3)
+	for i := range nodes {
+		nodes[i] = New(time.Second)
+		nodes[i].SetLogger(nil)
+		srv := httptest.NewServer(nodes[i])
+		defer srv.Close()
+		urls[i] = srv.URL
+	}
+	for i, r := range nodes {
+		var peers []string
+		for j, u := range urls {
+			if j != i {
+				peers = append(peers, u)
+			}
+		}
+		r.SetPeers(urls[i], peers, time.Millisecond*20)
+		defer r.Close()
+	}
+
+	// 第一个注册中心不可用时向下一个发送心跳
+	_assert(sendHeartbeat("http://127.0.0.1:1,"+urls[0], ServerItem{Addr: "tcp@a", Tags: []string{"v1"}}) == nil, "failed to send heartbeat")
+	_assert(waitNodes(nodes, func(alive []string) bool { return fmt.Sprint(alive) == "[tcp@a]" }), "expect server to be replicated to all nodes")
+
+	// 覆盖配置同步到所有节点
+	nodes[1].SetOverride(Override{Addr: "tcp@a", Disabled: true})
+	_assert(waitNodes(nodes, func(alive []string) bool { return len(alive) == 0 }), "expect override to be replicated")
+	nodes[2].SetOverride(Override{Addr: "tcp@a"})
+	_assert(waitNodes(nodes, func(alive []string) bool { return fmt.Sprint(alive) == "[tcp@a]" }), "expect override removal to be replicated")
+
+	// 只向一个节点发送心跳 其他节点也保持存活
+	for i := 0; i < 12; i++ {
+		_ = sendHeartbeat(urls[0], ServerItem{Addr: "tcp@a", Tags: []string{"v2"}})
+		time.Sleep(time.Millisecond * 100)
+	}
+	for i, r := range nodes {
+		alive, _, _, _ := r.snapshot(query{})
+		_assert(len(alive) == 1 && alive[0].HasTag("v2"), "expect node %d to keep server alive with latest metadata", i)
+	}
+
+	// 在另一个节点注销 墓碑同步到所有节点
+	_assert(Deregister(urls[2], "", "tcp@a") == nil, "failed to deregister")
+	_assert(waitNodes(nodes, func(alive []string) bool { return len(alive) == 0 }), "expect deregistration to be replicated")
+	time.Sleep(time.Millisecond * 100)
+	_assert(waitNodes(nodes, func(alive []string) bool { return len(alive) == 0 }), "expect server not to be resurrected")
+
+	// 只接收来自peers的同步
+	replicate := func(r *GeeRegistry, remoteAddr string) int {
+		body := `{"node":"evil","clock":100,"entries":[{"item":{"addr":"tcp@evil"},"version":100,"node":"evil"}]}`
+		req := httptest.NewRequest("PUT", "/", strings.NewReader(body))
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	_assert(replicate(nodes[0], "10.0.0.1:1234") == http.StatusForbidden, "expect replication from non-peer to be rejected")
+	single := New(time.Minute)
+	single.SetLogger(nil)
+	_assert(replicate(single, "127.0.0.1:1234") == http.StatusForbidden, "expect replication to be rejected outside cluster mode")
+	alive, _, _, _ := nodes[0].snapshot(query{})
+	_assert(len(alive) == 0, "expect injected state to be ignored, got %v", addrs(alive))
+	_assert(replicate(nodes[0], "127.0.0.1:1234") == http.StatusOK, "expect replication from peer host to be accepted")
+}
+
+func TestGeeRegistry_OverrideExpiry(t *testing.T) {
+	r := New(time.Second)
+	r.SetLogger(nil)
+	r.SetPeers("node", nil, time.Hour)
+	defer r.Close()
+	r.SetOverride(Override{Addr: "tcp@a", Disabled: true})
+	r.SetOverride(Override{Addr: "tcp@a"}) // 取消覆盖
+	_, ok := r.GetOverride("", "tcp@a")
+	state := r.replicaState()
+	_assert(!ok && len(state.Overrides) == 1, "expect cancelled override to be kept for replication")
+
+	// 与墓碑一样过期后删除
+	r.mu.Lock()
+	r.overrides[itemKey("", "tcp@a")].at = time.Now().Add(-minTombstoneTTL)
+	r.mu.Unlock()
+	state = r.replicaState()
+	r.mu.Lock()
+	n := len(r.overrides)
+	r.mu.Unlock()
+	_assert(len(state.Overrides) == 0 && n == 0, "expect cancelled override to expire, got %d", n)
+}
+
+type Foo struct {
+	hung int32 // 为1时模拟进程卡住
+}
+
+func (f *Foo) Ping(args int, reply *int) error {
+	if atomic.LoadInt32(&f.hung) == 1 {
+		time.Sleep(time.Millisecond * 200)
+	}
+	*reply = args
+	return nil
+}
+
+func TestGeeRegistry_Probe(t *testing.T) {
+	var foo Foo
+	server := geerpc.NewServer()
+	server.SetLogger(nil)
+	_ = server.Register(&foo)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer l.Close()
+	go server.Accept(l)
+	addr := "tcp@" + l.Addr().String()
+
+	r := New(0)
+	r.SetLogger(nil)
+	r.putServer(ServerItem{Addr: addr})
+	r.putServer(ServerItem{Addr: "tcp@127.0.0.1:1"}) // 无法连接
+	_, index, _, _ := r.snapshot(query{})
+	_, err := RPCProbe("Foo.Ping", 1, 0, nil)
+	_assert(err != nil, "expect error for non-pointer reply")
+	probe, err := RPCProbe("Foo.Ping", 1, new(int), nil)
+	_assert(err == nil, "failed to create rpc probe: %v", err)
+	r.SetProbe(&ProbeOption{
+		Interval:         time.Millisecond * 20,
+		Timeout:          time.Millisecond * 50,
+		Probe:            probe,
+		FailureThreshold: 2,
+	})
+	defer r.Close()
+
+	wait := func(expect string) bool {
+		for deadline := time.Now().Add(time.Second * 2); time.Now().Before(deadline); time.Sleep(time.Millisecond * 10) {
+			alive, _, _, _ := r.snapshot(query{})
+			if fmt.Sprint(addrs(alive)) == expect {
+				return true
+			}
+		}
+		return false
+	}
+	_assert(wait("["+addr+"]"), "expect unreachable server to be unhealthy")
+	_, index2, _, _ := r.snapshot(query{})
+	_assert(index2 > index, "expect index to change when health changes")
+
+	// 进程卡住但心跳正常
+	atomic.StoreInt32(&foo.hung, 1)
+	r.putServer(ServerItem{Addr: addr})
+	_assert(wait("[]"), "expect hung server to be unhealthy")
+	r.putServer(ServerItem{Addr: addr})
+	alive, _, _, _ := r.snapshot(query{})
+	_assert(len(alive) == 0, "expect heartbeat not to restore unhealthy server")
+
+	atomic.StoreInt32(&foo.hung, 0)
+	_assert(wait("["+addr+"]"), "expect server to be healthy again")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_assert(TCPProbe()(ctx, addr) == nil, "expect tcp probe to succeed")
+	_assert(TCPProbe()(ctx, "tcp@127.0.0.1:1") != nil, "expect tcp probe to fail")
+}
+
+func TestGeeRegistry_Admin(t *testing.T) {
+	r := New(time.Minute)
+	r.SetLogger(nil)
+	mux := http.NewServeMux()
+	mux.Handle("/registry", r)
+	mux.Handle("/registry/admin", r.AdminHandler())
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	r.putServer(ServerItem{Addr: "tcp@a", Services: []string{"Foo"}})
+	r.putServer(ServerItem{Addr: "tcp@b", Services: []string{"Foo"}, Weight: 1})
+
+	post := func(form url.Values) int {
+		req, _ := http.NewRequest("POST", ts.URL+"/registry/admin", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-Requested-With", "XMLHttpRequest")
+		resp, err := http.DefaultClient.Do(req)
+		_assert(err == nil, "failed to post admin: %v", err)
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+	// 表单和跨域请求不能修改覆盖配置
+	resp, err := http.PostForm(ts.URL+"/registry/admin", url.Values{"addr": {"tcp@a"}, "disabled": {"true"}})
+	_assert(err == nil && resp.StatusCode == http.StatusForbidden, "expect form post to be rejected: %v", err)
+	_ = resp.Body.Close()
+	req, _ := http.NewRequest("POST", ts.URL+"/registry/admin?addr=tcp@a&disabled=true", nil)
+	req.Header.Set("X-Requested-With", "XMLHttpRequest")
+	req.Header.Set("Origin", "http://evil.example.com")
+	resp, err = http.DefaultClient.Do(req)
+	_assert(err == nil && resp.StatusCode == http.StatusForbidden, "expect cross-origin post to be rejected: %v", err)
+	_ = resp.Body.Close()
+	_, ok := r.GetOverride("", "tcp@a")
+	_assert(!ok, "expect no override from rejected requests")
+
+	_assert(post(url.Values{"addr": {"tcp@a"}, "disabled": {"true"}}) == http.StatusOK, "failed to disable server")
+	_assert(post(url.Values{"addr": {"tcp@b"}, "weight": {"5"}}) == http.StatusOK, "failed to override weight")
+	_assert(post(url.Values{"addr": {"tcp@b"}, "weight": {"-1"}}) == http.StatusBadRequest, "expect invalid weight to be rejected")
+	r.putServer(ServerItem{Addr: "tcp@b", Services: []string{"Foo"}, Weight: 1}) // 心跳不影响覆盖配置
+
+	alive, _, _, _ := r.snapshot(query{service: "Foo"})
+	_assert(len(alive) == 1 && alive[0].Addr == "tcp@b" && alive[0].Weight == 5, "unexpected servers %+v", alive)
+
+	resp, err = http.Get(ts.URL + "/registry/admin?format=json")
+	_assert(err == nil, "failed to get admin info: %v", err)
+	var info adminInfo
+	err = json.NewDecoder(resp.Body).Decode(&info)
+	_ = resp.Body.Close()
+	_assert(err == nil && len(info.Instances) == 2 && len(info.Overrides) == 2, "unexpected admin info %+v %v", info, err)
+	a, b := info.Instances[0], info.Instances[1]
+	_assert(a.Disabled && a.Health == "unknown", "unexpected instance %+v", a)
+	_assert(b.Weight == 5 && b.ReportedWeight == 1 && b.WeightOverride == 5, "unexpected instance %+v", b)
+	_assert(fmt.Sprint(info.Services) == "[{ Foo 1 2}]", "unexpected services %+v", info.Services)
+
+	resp, err = http.Get(ts.URL + "/registry/admin")
+	_assert(err == nil, "failed to get admin page: %v", err)
+	page, _ := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	_assert(strings.Contains(string(page), "tcp@a") && strings.Contains(string(page), "Enable"), "unexpected admin page")
+
+	req, _ = http.NewRequest("DELETE", ts.URL+"/registry/admin?addr=tcp@a", nil)
+	resp, _ = http.DefaultClient.Do(req)
+	_assert(resp.StatusCode == http.StatusForbidden, "expect delete without X-Requested-With to be rejected")
+	_ = resp.Body.Close()
+	req.Header.Set("X-Requested-With", "XMLHttpRequest")
+	req.Header.Set("Origin", ts.URL) // 同源的请求
+	resp, err = http.DefaultClient.Do(req)
+	_assert(err == nil && resp.StatusCode == http.StatusOK, "failed to delete override: %v", err)
+	_ = resp.Body.Close()
+	resp, _ = http.DefaultClient.Do(req)
+	_assert(resp.StatusCode == http.StatusNotFound, "expect 404 when override does not exist")
+	_ = resp.Body.Close()
+	alive, _, _, _ = r.snapshot(query{})
+	_assert(fmt.Sprint(addrs(alive)) == "[tcp@a tcp@b]", "expect enabled server to be returned, got %v", addrs(alive))
+}
+
+// 启动提供Registry服务的geerpc服务端 返回protocol@addr格式的地址
+func startRegistryRPC(r *GeeRegistry) (string, net.Listener) {
+	server := geerpc.NewServer()
+	server.SetLogger(nil)
+	_ = server.Register(r.Service())
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go server.Accept(l)
+	return "tcp@" + l.Addr().String(), l
+}
+
+func TestRegistryClient(t *testing.T) {
+	r := New(time.Minute)
+	r.SetLogger(nil)
+	addr, l := startRegistryRPC(r)
+	defer l.Close()
+	rc := NewRegistryClient(addr, nil)
+	defer rc.Close()
+	ctx := context.Background()
+
+	_assert(rc.Register(ctx, ServerItem{Addr: "tcp@a", Services: []string{"Foo"}}) == nil, "failed to register")
+	_assert(rc.Heartbeat(ctx, ServerItem{Addr: "tcp@b", Namespace: "other"}) == nil, "failed to send heartbeat")
+	_assert(rc.Register(ctx, ServerItem{}) != nil, "expect register without address to fail")
+	result, err := rc.List(ctx, Query{Service: "Foo"})
+	_assert(err == nil && fmt.Sprint(addrs(result.Servers)) == "[tcp@a]", "unexpected list %+v %v", result, err)
+	result, err = rc.List(ctx, Query{Namespace: "other"})
+	_assert(err == nil && fmt.Sprint(addrs(result.Servers)) == "[tcp@b]", "unexpected list %+v %v", result, err)
+
+	// 版本号变化时长轮询立即返回
+	index := result.Index
+	go func() {
+		time.Sleep(time.Millisecond * 100)
+		_ = rc.Heartbeat(ctx, ServerItem{Addr: "tcp@c", Namespace: "other"})
+	}()
+	result, err = rc.Watch(ctx, Query{Namespace: "other"}, index, time.Second*5)
+	_assert(err == nil && result.Index != index && fmt.Sprint(addrs(result.Servers)) == "[tcp@b tcp@c]", "unexpected watch %+v %v", result, err)
+
+	_assert(rc.Deregister(ctx, "other", "tcp@b") == nil, "failed to deregister")
+	_assert(rc.Deregister(ctx, "other", "tcp@b") == nil, "expect deregistering a missing instance to succeed")
+	result, err = rc.List(ctx, Query{Namespace: "other"})
+	_assert(err == nil && fmt.Sprint(addrs(result.Servers)) == "[tcp@c]", "unexpected list %+v %v", result, err)
+
+	// 多个goroutine同时使用
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = rc.List(ctx, Query{})
+		}()
+	}
+	wg.Wait()
+
+	h := rc.HeartbeatWithOption(ServerItem{Addr: "tcp@d"}, &HeartbeatOption{Duration: time.Hour, Logger: geerpc.NopLogger})
+	result, _ = rc.List(ctx, Query{})
+	_assert(fmt.Sprint(addrs(result.Servers)) == "[tcp@a tcp@d]", "expect tcp@d to be registered, got %v", addrs(result.Servers))
+	_assert(h.Stop() == nil, "failed to stop heartbeat")
+	result, _ = rc.List(ctx, Query{})
+	_assert(fmt.Sprint(addrs(result.Servers)) == "[tcp@a]", "expect tcp@d to be deregistered, got %v", addrs(result.Servers))
+
+	_ = rc.Close()
+	_assert(rc.Register(ctx, ServerItem{Addr: "tcp@e"}) == geerpc.ErrShutdown, "expect calls after Close to fail")
+}
+
+func TestRegistryClient_Failover(t *testing.T) {
+	down, _ := net.Listen("tcp", "127.0.0.1:0")
+	downAddr := "tcp@" + down.Addr().String()
+	_ = down.Close()
+	r1, r2 := New(time.Minute), New(time.Minute)
+	r1.SetLogger(nil)
+	r2.SetLogger(nil)
+	addr1, l1 := startRegistryRPC(r1)
+	addr2, l2 := startRegistryRPC(r2)
+	defer l2.Close()
+
+	// 第一个注册中心不可用时依次尝试下一个
+	rc := NewRegistryClient(downAddr+", "+addr1+", "+addr2, nil)
+	defer rc.Close()
+	ctx := context.Background()
+	_assert(rc.Register(ctx, ServerItem{Addr: "tcp@a"}) == nil, "failed to register with the first registry down")
+	alive, _, _, _ := r1.snapshot(query{})
+	_assert(fmt.Sprint(addrs(alive)) == "[tcp@a]", "expect tcp@a to be registered to the second registry, got %v", addrs(alive))
+
+	// 当前注册中心断开后切换到下一个
+	_ = l1.Close()
+	rc.mu.Lock()
+	_ = rc.client.Close()
+	rc.mu.Unlock()
+	_assert(rc.Heartbeat(ctx, ServerItem{Addr: "tcp@a"}) == nil, "failed to fail over to the third registry")
+	alive, _, _, _ = r2.snapshot(query{})
+	_assert(fmt.Sprint(addrs(alive)) == "[tcp@a]", "expect tcp@a to be registered to the third registry, got %v", addrs(alive))
+
+	// 服务端返回的错误不切换注册中心
+	_assert(rc.Register(ctx, ServerItem{}) != nil, "expect register without address to fail")
+	rc.mu.Lock()
+	current := rc.current
+	rc.mu.Unlock()
+	_assert(current == 2, "expect server errors not to switch registries, current %d", current)
+}
+
+func TestGeeRegistry_Auth(t *testing.T) {
+	r := New(time.Minute)
+	r.SetLogger(nil)
+	r.SetTokens(map[string]Credential{
+		"a-rw":  {Namespaces: []string{"a"}, Permission: ReadPermission | WritePermission},
+		"a-ro":  {Namespaces: []string{"a"}, Permission: ReadPermission},
+		"admin": {Namespaces: []string{AllNamespaces}, Permission: ReadPermission | WritePermission | AdminPermission},
+	})
+	mux := http.NewServeMux()
+	mux.Handle("/registry", r)
+	mux.Handle("/registry/admin", r.AdminHandler())
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	withToken := func(token string) string {
+		return strings.Replace(ts.URL, "http://", "http://:"+token+"@", 1) + "/registry"
+	}
+
+	_assert(sendHeartbeat(ts.URL+"/registry", ServerItem{Addr: "tcp@a", Namespace: "a"}) != nil, "expect heartbeat without token to fail")
+	_assert(sendHeartbeat(withToken("a-ro"), ServerItem{Addr: "tcp@a", Namespace: "a"}) != nil, "expect read only token not to write")
+	_assert(sendHeartbeat(withToken("a-rw"), ServerItem{Addr: "tcp@b", Namespace: "b"}) != nil, "expect token not to write other namespace")
+	_assert(sendHeartbeat(withToken("a-rw"), ServerItem{Addr: "tcp@a", Namespace: "a"}) == nil, "failed to send heartbeat with token")
+	_assert(sendHeartbeat(strings.Replace(ts.URL, "http://", "http://admin@", 1)+"/registry", ServerItem{Addr: "tcp@b", Namespace: "b"}) != nil, "expect token as username to be rejected")
+	_assert(sendHeartbeat(strings.Replace(ts.URL, "http://", "http://:admin@", 1)+"/registry", ServerItem{Addr: "tcp@b", Namespace: "b"}) == nil, "failed to send heartbeat with admin token")
+
+	get := func(rawURL, token string) (int, QueryResult) {
+		req, _ := http.NewRequest("GET", rawURL, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		_assert(err == nil, "failed to get %s: %v", rawURL, err)
+		defer resp.Body.Close()
+		var result QueryResult
+		_ = json.NewDecoder(resp.Body).Decode(&result)
+		return resp.StatusCode, result
+	}
+	code, result := get(ts.URL+"/registry?format=json&namespace=a", "a-ro")
+	_assert(code == http.StatusOK && fmt.Sprint(addrs(result.Servers)) == "[tcp@a]", "unexpected result %d %+v", code, result)
+	code, _ = get(ts.URL+"/registry?format=json&namespace=b", "a-ro")
+	_assert(code == http.StatusForbidden, "expect namespace b to be hidden from a-ro, got %d", code)
+	code, _ = get(ts.URL+"/registry?format=json&namespace=a", "")
+	_assert(code == http.StatusUnauthorized, "expect 401 without token, got %d", code)
+
+	// 管理页面只能看到有权限的命名空间
+	code, _ = get(ts.URL+"/registry/admin?format=json", "a-rw")
+	_assert(code == http.StatusForbidden, "expect admin page to require admin permission, got %d", code)
+	req, _ := http.NewRequest("GET", ts.URL+"/registry/admin?format=json", nil)
+	req.Header.Set("Authorization", "Bearer admin")
+	resp, err := http.DefaultClient.Do(req)
+	_assert(err == nil, "failed to get admin info: %v", err)
+	var info adminInfo
+	_ = json.NewDecoder(resp.Body).Decode(&info)
+	_ = resp.Body.Close()
+	_assert(len(info.Instances) == 2, "expect admin to see all namespaces, got %+v", info.Instances)
+
+	// geerpc协议
+	svc := r.Service()
+	var ok bool
+	_assert(svc.Register(RegisterArgs{Item: ServerItem{Addr: "tcp@c", Namespace: "b"}, Token: "a-rw"}, &ok) == errForbidden, "expect rpc register to be forbidden")
+	_assert(svc.Register(RegisterArgs{Item: ServerItem{Addr: "tcp@c", Namespace: "a"}, Token: "a-rw"}, &ok) == nil && ok, "failed to register through rpc")
+	var list QueryResult
+	_assert(svc.List(ListArgs{Query: Query{Namespace: "a"}}, &list) == errUnauthorized, "expect rpc list without token to fail")
+	_assert(svc.List(ListArgs{Query: Query{Namespace: "a"}, Token: "a-ro"}, &list) == nil && len(list.Servers) == 2, "unexpected rpc list %+v", list)
+
+	_assert(RedactToken(withToken("a-rw")+","+ts.URL) == withToken("xxxxx")+","+ts.URL, "unexpected redacted url %s", RedactToken(withToken("a-rw")))
+}
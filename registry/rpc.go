@@ -0,0 +1,317 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"geerpc"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* *****************************************************
+注册中心的geerpc协议：GeeRegistry通过Service()提供名为Registry的geerpc服务
+    server.Register(reg.Service())
+注册中心的流量因此可以使用与业务相同的编码方式、超时等设置
+Registry.Register    注册实例或更新元数据
+Registry.Heartbeat   发送心跳 携带完整的元数据 实例已经过期（或注册中心重启）时重新注册
+Registry.Deregister  注销实例
+Registry.List        查询可用的实例
+Registry.Watch       长轮询 服务列表的版本号与Index不同才返回
+                     注册中心最多等待Wait（不超过30s） 调用方的超时时间（以及Option.HandleTimeout）需要大于Wait
+                     服务端感知不到调用方断开 等待时间因此比HTTP协议短
+开启认证时token放在每个调用的参数中 权限与HTTP协议相同
+RegistryClient是对应的客户端 可以发送心跳 xclient中的服务发现也可以通过它监听服务列表
+***************************************************** */
+
+// 注册中心的geerpc服务
+type Registry struct {
+	r *GeeRegistry
+}
+
+type RegisterArgs struct {
+	Item  ServerItem
+	Token string
+}
+
+type DeregisterArgs struct {
+	Namespace string
+	Addr      string
+	Token     string
+}
+
+// 查询条件 为空的条件不过滤
+type Query struct {
+	Namespace string
+	Service   string
+	Zone      string
+	Version   string
+	Tags      []string // 需要带有所有的标签
+}
+
+func (q Query) query() query {
+	return query{namespace: q.Namespace, service: q.Service, zone: q.Zone, version: q.Version, tags: q.Tags}
+}
+
+type ListArgs struct {
+	Query Query
+	Token string
+}
+
+type WatchArgs struct {
+	Query Query
+	Index uint64        // 上次得到的服务列表的版本号
+	Wait  time.Duration // 最长等待时间 不大于0或超过30s时为30s
+	Token string
+}
+
+// 以geerpc服务的形式提供注册中心 服务名为Registry
+func (r *GeeRegistry) Service() *Registry {
+	return &Registry{r: r}
+}
+
+var errMissingAddr = errors.New("rpc registry: missing server address")
+
+// reply为是否是新注册的实例
+func (s *Registry) Register(args RegisterArgs, reply *bool) error {
+	if err := s.put(args); err != nil {
+		return err
+	}
+	*reply = s.r.putServer(args.Item)
+	if *reply {
+		s.r.logger.Printf("rpc registry: register %s", args.Item.Addr)
+	}
+	return nil
+}
+
+// reply为实例是否因为已经过期而被重新注册
+func (s *Registry) Heartbeat(args RegisterArgs, reply *bool) error {
+	if err := s.put(args); err != nil {
+		return err
+	}
+	*reply = s.r.putServer(args.Item)
+	return nil
+}
+
+// 检查注册和心跳的参数和权限
+func (s *Registry) put(args RegisterArgs) error {
+	if args.Item.Addr == "" {
+		return errMissingAddr
+	}
+	return s.r.authorize(args.Token, args.Item.Namespace, WritePermission)
+}
+
+// reply为实例是否存在
+func (s *Registry) Deregister(args DeregisterArgs, reply *bool) error {
+	if args.Addr == "" {
+		return errMissingAddr
+	}
+	if err := s.r.authorize(args.Token, args.Namespace, WritePermission); err != nil {
+		return err
+	}
+	*reply = s.r.removeServer(args.Namespace, args.Addr)
+	return nil
+}
+
+func (s *Registry) List(args ListArgs, reply *QueryResult) error {
+	if err := s.r.authorize(args.Token, args.Query.Namespace, ReadPermission); err != nil {
+		return err
+	}
+	alive, index, _, _ := s.r.snapshot(args.Query.query())
+	*reply = QueryResult{Index: index, Servers: alive}
+	return nil
+}
+
+// 服务端不能感知调用方取消或连接断开 最多在Wait之后返回 Wait不超过maxRPCWait
+func (s *Registry) Watch(args WatchArgs, reply *QueryResult) error {
+	if err := s.r.authorize(args.Token, args.Query.Namespace, ReadPermission); err != nil {
+		return err
+	}
+	wait := clampWait(args.Wait)
+	if wait > maxRPCWait {
+		wait = maxRPCWait
+	}
+	alive, index := s.r.watch(context.Background(), args.Query.query(), args.Index, wait)
+	*reply = QueryResult{Index: index, Servers: alive}
+	return nil
+}
+
+// 通过geerpc访问注册中心的客户端 可以被多个goroutine同时使用
+type RegistryClient struct {
+	addrs   []string // 注册中心的geerpc地址 有多个时依次尝试
+	opt     *geerpc.Option
+	mu      sync.Mutex
+	client  *geerpc.Client
+	current int // 当前连接的注册中心
+	closed  bool
+	token   string
+}
+
+const (
+	rpcCallTimeout = time.Second * 10 // 心跳和注销的超时时间
+	maxRPCWait     = defaultWait      // geerpc协议长轮询的最长等待时间 连接断开后等待的goroutine最多再存在这么久
+)
+
+// registryAddr为protocol@addr格式的geerpc地址 可以是以逗号分隔的多个注册中心（集群中的多个节点）
+// 连接失败时依次尝试下一个 opt为nil时使用geerpc.DefaultOption 第一次调用时建立连接
+func NewRegistryClient(registryAddr string, opt *geerpc.Option) *RegistryClient {
+	addrs := strings.Split(registryAddr, ",")
+	for i := range addrs {
+		addrs[i] = strings.TrimSpace(addrs[i])
+	}
+	return &RegistryClient{addrs: addrs, opt: opt}
+}
+
+// 设置访问注册中心的token 需要在调用之前设置
+func (c *RegistryClient) SetToken(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.token = token
+}
+
+func (c *RegistryClient) getToken() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.token
+}
+
+// 获取当前注册中心的连接及其序号 断开时重新连接 建立连接时不持有c.mu
+func (c *RegistryClient) get() (*geerpc.Client, int, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, 0, geerpc.ErrShutdown
+	}
+	current := c.current
+	if c.client != nil && c.client.IsAvailable() {
+		client := c.client
+		c.mu.Unlock()
+		return client, current, nil
+	}
+	if c.client != nil {
+		_ = c.client.Close()
+		c.client = nil
+	}
+	c.mu.Unlock()
+
+	var opts []*geerpc.Option
+	if c.opt != nil {
+		opts = append(opts, c.opt)
+	}
+	client, err := geerpc.XDial(c.addrs[current], opts...)
+	if err != nil {
+		return nil, current, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		_ = client.Close()
+		return nil, current, geerpc.ErrShutdown
+	}
+	if c.client != nil && c.client.IsAvailable() { // 其他goroutine同时建立了连接
+		_ = client.Close()
+		return c.client, c.current, nil
+	}
+	if c.client != nil {
+		_ = c.client.Close()
+	}
+	c.client, c.current = client, current
+	return client, current, nil
+}
+
+// 第current个注册中心的连接不可用时切换到下一个注册中心
+func (c *RegistryClient) next(client *geerpc.Client, current int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.current != current || c.client != client { // 其他goroutine已经切换过或重新连接过
+		return
+	}
+	if client != nil {
+		_ = client.Close()
+	}
+	c.client = nil
+	c.current = (current + 1) % len(c.addrs)
+}
+
+// 调用注册中心的方法 连接错误时依次尝试其他注册中心 服务端返回的错误不切换
+func (c *RegistryClient) call(ctx context.Context, method string, args, reply interface{}) error {
+	var err error
+	for i := 0; i < len(c.addrs); i++ {
+		var client *geerpc.Client
+		var current int
+		if client, current, err = c.get(); err == nil {
+			if err = client.Call(ctx, "Registry."+method, args, reply); err == nil || client.IsAvailable() {
+				return err
+			}
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+		c.next(client, current)
+	}
+	return err
+}
+
+func (c *RegistryClient) Register(ctx context.Context, item ServerItem) error {
+	var registered bool
+	return c.call(ctx, "Register", RegisterArgs{Item: item, Token: c.getToken()}, &registered)
+}
+
+func (c *RegistryClient) Heartbeat(ctx context.Context, item ServerItem) error {
+	var registered bool
+	return c.call(ctx, "Heartbeat", RegisterArgs{Item: item, Token: c.getToken()}, &registered)
+}
+
+// 实例不存在时同样返回nil
+func (c *RegistryClient) Deregister(ctx context.Context, namespace, addr string) error {
+	var existed bool
+	return c.call(ctx, "Deregister", DeregisterArgs{Namespace: namespace, Addr: addr, Token: c.getToken()}, &existed)
+}
+
+func (c *RegistryClient) List(ctx context.Context, q Query) (*QueryResult, error) {
+	var result QueryResult
+	if err := c.call(ctx, "List", ListArgs{Query: q, Token: c.getToken()}, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// 服务列表的版本号与index不同、或者等待超过wait后返回 ctx的超时时间需要大于wait
+func (c *RegistryClient) Watch(ctx context.Context, q Query, index uint64, wait time.Duration) (*QueryResult, error) {
+	var result QueryResult
+	if err := c.call(ctx, "Watch", WatchArgs{Query: q, Index: index, Wait: wait, Token: c.getToken()}, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// 与HeartbeatInstance相同 通过geerpc发送心跳 Stop时通过geerpc注销实例
+func (c *RegistryClient) HeartbeatInstance(item ServerItem, server *geerpc.Server, duration time.Duration) *HeartbeatHandle {
+	return c.HeartbeatWithOption(item, &HeartbeatOption{Server: server, Duration: duration})
+}
+
+// 与HeartbeatWithOption相同 通过geerpc发送心跳和注销实例
+func (c *RegistryClient) HeartbeatWithOption(item ServerItem, opt *HeartbeatOption) *HeartbeatHandle {
+	return startHeartbeat(strings.Join(c.addrs, ","), item, opt, func(item ServerItem) error {
+		ctx, cancel := context.WithTimeout(context.Background(), rpcCallTimeout)
+		defer cancel()
+		return c.Heartbeat(ctx, item)
+	}, func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), rpcCallTimeout)
+		defer cancel()
+		return c.Deregister(ctx, item.Namespace, item.Addr)
+	})
+}
+
+// 关闭与注册中心的连接 之后的调用返回geerpc.ErrShutdown
+func (c *RegistryClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	if c.client == nil {
+		return nil
+	}
+	err := c.client.Close()
+	c.client = nil
+	return err
+}
@@ -0,0 +1,288 @@
+package registry
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+/* *****************************************************
+注册中心的持久化：服务列表和覆盖配置的每次变化追加到日志文件，
+日志记录数达到compactEvery时把当前的服务列表写入快照并清空日志。
+启动时先读取快照再重放日志，最后一条记录写了一半（崩溃）时忽略它。
+变化在持有r.mu时排队，释放r.mu之后才写入磁盘，写入期间查询和长轮询不会被阻塞。
+读取时发现的过期不写入磁盘，重启后这些实例在grace之后再次过期
+***************************************************** */
+
+const (
+	snapshotFile        = "snapshot.json"
+	logFile             = "registry.log"
+	defaultCompactEvery = 1000
+)
+
+const (
+	opPut      = "put"
+	opDelete   = "delete"
+	opOverride = "override"
+)
+
+type storeRecord struct {
+	Op       string     `json:"op"`
+	Index    uint64     `json:"index"`              // 变化后服务列表的版本号
+	Item     ServerItem `json:"item"`               // 删除时只有Namespace和Addr
+	Override *Override  `json:"override,omitempty"` // 覆盖配置的变化 取消时为空的覆盖配置
+}
+
+type snapshotData struct {
+	Index     uint64       `json:"index"`
+	Servers   []ServerItem `json:"servers"`
+	Overrides []Override   `json:"overrides,omitempty"`
+}
+
+// 注册中心的磁盘存储 只能被一个GeeRegistry使用
+type Store struct {
+	dir          string
+	mu           sync.Mutex
+	log          *os.File
+	records      int // 上次快照之后的日志记录数
+	compactEvery int
+}
+
+// 打开dir中的存储 dir不存在时创建
+func OpenStore(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, logFile), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &Store{dir: dir, log: f, compactEvery: defaultCompactEvery}, nil
+}
+
+// 读取快照并重放日志 返回恢复的服务列表、覆盖配置和版本号
+func (s *Store) load() (map[string]*ServerItem, map[string]*Override, uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	servers := make(map[string]*ServerItem)
+	overrides := make(map[string]*Override)
+	var snap snapshotData
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, snapshotFile))
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &snap); err != nil {
+			return nil, nil, 0, err
+		}
+	case !os.IsNotExist(err):
+		return nil, nil, 0, err
+	}
+	for i := range snap.Servers {
+		item := snap.Servers[i]
+		servers[itemKey(item.Namespace, item.Addr)] = &item
+	}
+	for i := range snap.Overrides {
+		o := snap.Overrides[i]
+		overrides[itemKey(o.Namespace, o.Addr)] = &o
+	}
+	index := snap.Index
+	if _, err := s.log.Seek(0, 0); err != nil {
+		return nil, nil, 0, err
+	}
+	scanner := bufio.NewScanner(s.log)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	s.records = 0
+	for scanner.Scan() {
+		var rec storeRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			break // 崩溃时写了一半的记录 之后不会有完整的记录
+		}
+		key := itemKey(rec.Item.Namespace, rec.Item.Addr)
+		switch rec.Op {
+		case opPut:
+			item := rec.Item
+			servers[key] = &item
+		case opDelete:
+			delete(servers, key)
+		case opOverride:
+			if rec.Override == nil {
+				break
+			}
+			if key = itemKey(rec.Override.Namespace, rec.Override.Addr); rec.Override.empty() {
+				delete(overrides, key)
+			} else {
+				overrides[key] = rec.Override
+			}
+		}
+		if rec.Index > index {
+			index = rec.Index
+		}
+		s.records++
+	}
+	return servers, overrides, index, scanner.Err()
+}
+
+// 追加n条记录之后是否需要写快照
+func (s *Store) due(n int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.records+n >= s.compactEvery
+}
+
+// 追加记录 所有记录写入后同步一次
+func (s *Store) append(recs []storeRecord) error {
+	var buf []byte
+	for i := range recs {
+		data, err := json.Marshal(&recs[i])
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, data...), '\n')
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.log.Write(buf); err != nil {
+		return err
+	}
+	s.records += len(recs)
+	return s.log.Sync()
+}
+
+// 写入快照并清空日志 先写临时文件再重命名 保证快照文件总是完整的
+func (s *Store) compact(snap *snapshotData) error {
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tmp := filepath.Join(s.dir, snapshotFile+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(s.dir, snapshotFile)); err != nil {
+		return err
+	}
+	// 快照已经包含了日志中的所有变化 清空日志
+	if err := s.log.Truncate(0); err != nil {
+		return err
+	}
+	s.records = 0
+	return s.log.Sync()
+}
+
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.log.Close()
+}
+
+// 使用store持久化服务列表和覆盖配置 先从store恢复服务列表和覆盖配置
+// 恢复的实例在grace内没有收到心跳时过期 grace为0时使用注册中心的超时时间
+// 需要在注册中心开始处理请求之前调用
+func (r *GeeRegistry) SetStore(store *Store, grace time.Duration) error {
+	servers, overrides, index, err := store.load()
+	if err != nil {
+		return err
+	}
+	if grace <= 0 {
+		grace = r.timeout
+	}
+	r.storeMu.Lock()
+	defer r.storeMu.Unlock()
+	r.mu.Lock()
+	start := time.Now().Add(grace - r.timeout) // 恢复的实例在grace之后过期
+	for key, item := range servers {
+		item.start = start
+		r.servers[key] = item
+	}
+	for key, o := range overrides {
+		o.node = r.node
+		r.overrides[key] = o
+	}
+	r.store = store
+	r.index = index
+	r.changeLocked()
+	r.pending = nil // 已经包含在快照中
+	snap := r.snapshotDataLocked()
+	r.mu.Unlock()
+	r.logger.Printf("rpc registry: restore %d servers and %d overrides from %s", len(servers), len(overrides), store.dir)
+	return store.compact(snap)
+}
+
+// 当前的服务列表和覆盖配置 需要持有r.mu
+func (r *GeeRegistry) snapshotDataLocked() *snapshotData {
+	snap := &snapshotData{Index: r.index, Servers: make([]ServerItem, 0, len(r.servers))}
+	for _, item := range r.servers {
+		snap.Servers = append(snap.Servers, *item)
+	}
+	for _, o := range r.overrides {
+		if !o.empty() {
+			snap.Overrides = append(snap.Overrides, *o)
+		}
+	}
+	return snap
+}
+
+// 持久化服务列表的一次变化 需要持有r.mu 在changeLocked之后调用
+// 变化先排队 释放r.mu之后由flushStore写入
+func (r *GeeRegistry) persistLocked(op string, item ServerItem) {
+	if r.store == nil {
+		return
+	}
+	if op == opDelete {
+		item = ServerItem{Namespace: item.Namespace, Addr: item.Addr}
+	}
+	r.pending = append(r.pending, storeRecord{Op: op, Index: r.index, Item: item})
+}
+
+// 持久化覆盖配置的一次变化 需要持有r.mu 在changeLocked之后调用
+func (r *GeeRegistry) persistOverrideLocked(o Override) {
+	if r.store == nil {
+		return
+	}
+	r.pending = append(r.pending, storeRecord{Op: opOverride, Index: r.index, Override: &o})
+}
+
+// 把排队的变化写入磁盘 不能持有r.mu
+// 日志记录数达到compactEvery时改为写入当前状态的快照 快照已经包含了排队的变化
+// 写入失败只记录日志 不影响注册中心在内存中的状态
+func (r *GeeRegistry) flushStore() {
+	r.storeMu.Lock()
+	defer r.storeMu.Unlock()
+	r.mu.Lock()
+	store, pending := r.store, r.pending
+	r.pending = nil
+	var snap *snapshotData
+	if store != nil && len(pending) > 0 && store.due(len(pending)) {
+		snap = r.snapshotDataLocked()
+	}
+	r.mu.Unlock()
+	if store == nil || len(pending) == 0 {
+		return
+	}
+	var err error
+	if snap != nil {
+		err = store.compact(snap)
+	} else {
+		err = store.append(pending)
+	}
+	if err != nil {
+		r.logger.Printf("rpc registry: persist err: %v", err)
+	}
+}
@@ -1,17 +1,19 @@
 package geerpc
 
 import (
+	"bufio"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"geerpc/codec"
 	"io"
-	"log"
 	"net"
 	"net/http"
 	"reflect"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -22,6 +24,8 @@ type Option struct { // 存储消息编码方式，固定采用JSON编码Option
 	CodecType      codec.Type // 编码类型
 	ConnectTimeout time.Duration
 	HandleTimeout  time.Duration // 0 表示不设限制
+	Tracer         *Tracer       `json:"-"` // 客户端链路追踪 不参与编码 nil表示不开启
+	Logger         Logger        `json:"-"` // 客户端（包括XClient）的日志输出 nil表示使用DefaultLogger
 }
 
 var DefaultOption = &Option{ // 默认使用Gob编码
@@ -30,21 +34,57 @@ var DefaultOption = &Option{ // 默认使用Gob编码
 	ConnectTimeout: time.Second * 10,
 }
 
+func (opt *Option) logger() Logger {
+	if opt == nil || opt.Logger == nil {
+		return DefaultLogger
+	}
+	return opt.Logger
+}
+
 type Server struct {
-	serviceMap sync.Map // 存储结构体名以及对应的service对象
+	serviceMap      sync.Map // 存储结构体名以及对应的service对象
+	tracer          *Tracer  // 服务端链路追踪 nil表示不开启
+	logger          Logger
+	accessLog       Logger // 访问日志 nil表示不开启
+	accessLogFormat AccessLogFormat
+	mu              sync.Mutex
+	conns           map[uint64]*serverConn // 正在服务的连接 连接ID - 连接
+	connID          uint64                 // 最近分配的连接ID
 }
 
 func NewServer() *Server {
-	return &Server{}
+	return &Server{
+		logger: DefaultLogger,
+		conns:  make(map[uint64]*serverConn),
+	}
 }
 
 var DefaultServer = NewServer()
 
+// 设置服务端的链路追踪 需要在开始处理连接之前调用
+func (server *Server) SetTracer(tracer *Tracer) {
+	server.tracer = tracer
+}
+
+// 设置服务端的日志输出 nil表示丢弃所有日志
+func (server *Server) SetLogger(logger Logger) {
+	if logger == nil {
+		logger = NopLogger
+	}
+	server.logger = logger
+}
+
+// 开启访问日志 每处理完一个请求输出一条日志 logger为nil表示关闭
+func (server *Server) SetAccessLog(logger Logger, format AccessLogFormat) {
+	server.accessLog = logger
+	server.accessLogFormat = format
+}
+
 func (server *Server) Accept(lis net.Listener) {
 	for {
 		conn, err := lis.Accept()
 		if err != nil {
-			log.Println("rpc server: accept error: ", err)
+			server.logger.Printf("rpc server: accept error: %v", err)
 			return
 		}
 		go server.ServeConn(conn)
@@ -58,20 +98,114 @@ func Accept(lis net.Listener) {
 func (server *Server) ServeConn(conn io.ReadWriteCloser) {
 	// 解析获取报文编码方式
 	var opt Option
-	if err := json.NewDecoder(conn).Decode(&opt); err != nil {
-		log.Println("rpc server: options error: ", err)
+	dec := json.NewDecoder(conn)
+	if err := dec.Decode(&opt); err != nil {
+		server.logger.Printf("rpc server: options error: %v", err)
 		return
 	}
 	if opt.MagicNumber != MagicNumber {
-		log.Printf("rpc server: invalid magic number %x", opt.MagicNumber)
+		server.logger.Printf("rpc server: invalid magic number %x", opt.MagicNumber)
 		return
 	}
 	f := codec.NewCodecFuncMap[opt.CodecType]
 	if f == nil {
-		log.Printf("rpc server: invalid codec type %s", opt.CodecType)
+		server.logger.Printf("rpc server: invalid codec type %s", opt.CodecType)
 		return
 	}
-	server.serveCodec(f(conn), &opt) // 处理报文信息
+	// json.Decoder会预读数据 客户端紧跟着Option发送的请求可能已经在它的缓冲区中
+	// 另外json.Encoder会在Option之后写入一个换行符 需要跳过
+	br := bufio.NewReader(io.MultiReader(dec.Buffered(), conn))
+	if b, err := br.Peek(1); err == nil && b[0] == '\n' {
+		_, _ = br.Discard(1)
+	}
+	sc := &serverConn{
+		ReadWriteCloser: conn,
+		r:               br,
+		remoteAddr:      remoteAddr(conn),
+		opt:             &opt,
+		start:           time.Now(),
+		requests:        make(map[uint64]*request),
+	}
+	sc.cc = f(sc)
+	if ls, ok := sc.cc.(codec.LoggerSetter); ok {
+		ls.SetLogger(server.logger)
+	}
+	server.trackConn(sc, true)
+	defer server.trackConn(sc, false)
+	server.serveCodec(sc, &opt) // 处理报文信息
+}
+
+func (server *Server) trackConn(conn *serverConn, add bool) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if add {
+		server.connID++
+		conn.id = server.connID
+		server.conns[conn.id] = conn
+	} else {
+		delete(server.conns, conn.id)
+	}
+}
+
+// 服务端的一个连接 同时作为codec的底层I/O 统计读写的字节数用于访问日志
+type serverConn struct {
+	io.ReadWriteCloser               // 底层连接
+	r                  *bufio.Reader // 先读取json.Decoder缓冲区中剩余的数据 再读取底层连接
+	remoteAddr         string
+	opt                *Option   // 客户端协商的Option
+	start              time.Time // 连接建立的时间
+	cc                 codec.Codec
+	sending            sync.Mutex // 回复请求的报文必须逐个发送
+	nread              int64      // 只在读取请求的goroutine中访问
+	nwritten           int64      // 只在持有sending锁时访问
+	id                 uint64
+	numRequests        uint64 // 该连接上收到的请求数
+	mu                 sync.Mutex
+	requests           map[uint64]*request // 正在处理的请求 请求ID - 请求 Seq由客户端指定 可能重复 不能作为key
+	reqID              uint64              // 最近分配的请求ID
+}
+
+// 分配请求ID并记录为正在处理的请求
+func (c *serverConn) addRequest(req *request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reqID++
+	req.id = c.reqID
+	c.requests[req.id] = req
+}
+
+func (c *serverConn) removeRequest(req *request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.requests, req.id)
+}
+
+func (c *serverConn) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.nread += int64(n)
+	return n, err
+}
+
+// 实现io.ByteReader 使gob.Decoder不再额外包装一层bufio.Reader 保证读取的字节数准确
+func (c *serverConn) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.nread++
+	}
+	return b, err
+}
+
+func (c *serverConn) Write(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(p)
+	c.nwritten += int64(n)
+	return n, err
+}
+
+func remoteAddr(conn io.ReadWriteCloser) string {
+	if c, ok := conn.(interface{ RemoteAddr() net.Addr }); ok {
+		return c.RemoteAddr().String()
+	}
+	return ""
 }
 
 var invalidRequest = struct{}{} // 发生错误时响应的占位符
@@ -79,32 +213,48 @@ var invalidRequest = struct{}{} // 发生错误时响应的占位符
 // 分三个阶段：读取请求、处理请求、回复请求
 // 一次连接允许接收多个请求
 // 回复请求的报文必须逐个发送，因为并发容易导致多个回复报文交织在一起
-func (server *Server) serveCodec(cc codec.Codec, opt *Option) {
-	sending := new(sync.Mutex)
+func (server *Server) serveCodec(conn *serverConn, opt *Option) {
 	wg := new(sync.WaitGroup) // 处理完所有请求后再关闭连接
 	for {
-		req, err := server.readRequest(cc) // 底层采用gob的Decode方法 读取底层I/O流的下一个报文段
-		if err != nil {                    // 请求出错
+		nread := conn.nread
+		req, err := server.readRequest(conn.cc) // 底层采用gob的Decode方法 读取底层I/O流的下一个报文段
+		if req != nil {
+			req.size = conn.nread - nread
+			atomic.AddUint64(&conn.numRequests, 1)
+		}
+		if err != nil { // 请求出错
 			if req == nil {
 				break
 			}
 			req.h.Error = err.Error() // 设置错误信息
-			server.sendResponse(cc, req.h, invalidRequest, sending)
+			size := server.sendResponse(conn, req.h, invalidRequest)
+			server.logAccess(conn, req, statusError, size)
 			continue
 		}
 		wg.Add(1)
-		go server.handleRequest(cc, req, sending, wg, opt.HandleTimeout)
+		conn.addRequest(req)
+		go server.handleRequest(conn, req, wg, opt.HandleTimeout)
 	}
 	wg.Wait()
-	_ = cc.Close()
+	_ = conn.cc.Close()
 }
 
 // 一个RPC的请求信息
 type request struct {
 	h            *codec.Header
+	id           uint64        // 服务端分配的请求ID 在连接内唯一
 	argv, replyv reflect.Value // 类型需要通过反射在运行时确定
 	mtype        *methodType   // 请求调用的方法信息
 	svc          *service      // 请求调用的服务——结构体信息
+	start        time.Time     // 读取到请求头的时间
+	size         int64         // 请求报文的字节数
+	cancel       chan struct{} // 关闭后立即向客户端返回取消错误
+	cancelOnce   sync.Once
+}
+
+// 取消请求 服务方法无法被中断 但客户端会立即收到错误响应
+func (req *request) Cancel() {
+	req.cancelOnce.Do(func() { close(req.cancel) })
 }
 
 func (server *Server) readRequestHeader(cc codec.Codec) (*codec.Header, error) {
@@ -112,7 +262,7 @@ func (server *Server) readRequestHeader(cc codec.Codec) (*codec.Header, error) {
 	if err := cc.ReadHeader(&h); err != nil {
 		// io.ErrUnexpectedEOF表示读取固定大小的块或数据结构时遇到EOF
 		if err != io.EOF && err != io.ErrUnexpectedEOF {
-			log.Println("rpc server: read header error: ", err)
+			server.logger.Printf("rpc server: read header error: %v", err)
 		}
 		return nil, err
 	}
@@ -125,9 +275,10 @@ func (server *Server) readRequest(cc codec.Codec) (*request, error) {
 		return nil, err
 	}
 	// 构建完整的请求消息结构
-	req := &request{h: h}
+	req := &request{h: h, start: time.Now(), cancel: make(chan struct{})}
 	req.svc, req.mtype, err = server.findService(h.ServiceMethod)
 	if err != nil {
+		_ = cc.ReadBody(nil) // 丢弃请求体 保证连接上的下一个请求可以正常读取
 		return req, err
 	}
 	req.argv = req.mtype.newArgv()
@@ -138,53 +289,82 @@ func (server *Server) readRequest(cc codec.Codec) (*request, error) {
 		argvi = req.argv.Addr().Interface()
 	}
 	if err = cc.ReadBody(argvi); err != nil {
-		log.Println("rpc server: read argv err: ", err)
+		server.logger.Printf("rpc server: read argv err: %v", err)
 		return req, err
 	}
 	return req, nil
 }
 
-func (server *Server) sendResponse(cc codec.Codec, h *codec.Header, body interface{}, sending *sync.Mutex) {
+// 返回响应报文的字节数
+func (server *Server) sendResponse(conn *serverConn, h *codec.Header, body interface{}) int64 {
 	// 对同一个连接的多个请求依次回复
-	sending.Lock()
-	defer sending.Unlock()
-	if err := cc.Write(h, body); err != nil {
-		log.Println("rpc server: write response error: ", err)
+	conn.sending.Lock()
+	defer conn.sending.Unlock()
+	nwritten := conn.nwritten
+	if err := conn.cc.Write(h, body); err != nil {
+		server.logger.Printf("rpc server: write response error: %v", err)
 	}
+	return conn.nwritten - nwritten
 }
 
-func (server *Server) handleRequest(cc codec.Codec, req *request, sending *sync.Mutex, wg *sync.WaitGroup, timeout time.Duration) {
+func (server *Server) handleRequest(conn *serverConn, req *request, wg *sync.WaitGroup, timeout time.Duration) {
 	// 等待同一个连接的多个请求处理完再关闭连接
 	defer wg.Done()
+	defer conn.removeRequest(req)
 
 	// called设置为带缓存的channel 是为了防止超时情况下下面的goroutine阻塞在called<-struct{}{}导致无法退出 因为此时主函数已经退出
 	called := make(chan error, 1) // 传递RPC调用结束信号
+	span := server.tracer.newSpan(req.h.TraceID, req.h.SpanID, req.h.ServiceMethod, SpanKindServer)
 	go func() {
 		err := req.svc.call(req.mtype, req.argv, req.replyv) // 调用RPC方法
+		span.Finish(err)
 		called <- err
 	}()
 
-	if timeout == 0 { // 不限制是否超时
-		if err := <-called; err != nil {
-			req.h.Error = err.Error()
-			server.sendResponse(cc, req.h, invalidRequest, sending)
-		} else {
-			server.sendResponse(cc, req.h, req.replyv.Interface(), sending)
-		}
-		return
+	var timeoutCh <-chan time.Time // timeout为0时不限制是否超时 nil channel永远不会就绪
+	if timeout > 0 {
+		timeoutCh = time.After(timeout)
 	}
+	var err error
+	status := statusOK
 	select {
-	case <-time.After(timeout):
-		req.h.Error = fmt.Sprintf("rpc server: request handle timeout: expect within %s", timeout)
-		server.sendResponse(cc, req.h, invalidRequest, sending)
-	case err := <-called:
-		if err != nil {
-			req.h.Error = err.Error()
-			server.sendResponse(cc, req.h, invalidRequest, sending)
-		} else {
-			server.sendResponse(cc, req.h, req.replyv.Interface(), sending)
+	case <-timeoutCh:
+		err = fmt.Errorf("rpc server: request handle timeout: expect within %s", timeout)
+		status = statusTimeout
+	case <-req.cancel:
+		err = errors.New("rpc server: request cancelled")
+		status = statusCancelled
+	case err = <-called:
+	}
+	var size int64
+	if err != nil {
+		if status == statusOK {
+			status = statusError
 		}
+		req.h.Error = err.Error()
+		size = server.sendResponse(conn, req.h, invalidRequest)
+	} else {
+		size = server.sendResponse(conn, req.h, req.replyv.Interface())
+	}
+	server.logAccess(conn, req, status, size)
+}
+
+// 记录一条访问日志 未开启访问日志时什么都不做
+func (server *Server) logAccess(conn *serverConn, req *request, status string, respSize int64) {
+	if server.accessLog == nil {
+		return
+	}
+	entry := &AccessLog{
+		RemoteAddr:    conn.remoteAddr,
+		ServiceMethod: req.h.ServiceMethod,
+		Seq:           req.h.Seq,
+		Duration:      time.Since(req.start),
+		Status:        status,
+		Error:         req.h.Error,
+		RequestSize:   req.size,
+		ResponseSize:  respSize,
 	}
+	server.accessLog.Printf("%s", entry.format(server.accessLogFormat))
 }
 
 /* ****************************
@@ -197,6 +377,9 @@ func (server *Server) Register(rcvr interface{}) error {
 	if _, dup := server.serviceMap.LoadOrStore(s.name, s); dup {
 		return errors.New("rpc: service already defined: " + s.name)
 	}
+	for _, name := range s.methodNames() {
+		server.logger.Printf("rpc server: register %s.%s", s.name, name)
+	}
 	return nil
 }
 
@@ -204,6 +387,17 @@ func Register(rcvr interface{}) error {
 	return DefaultServer.Register(rcvr)
 }
 
+// 已注册的服务名 按名称排序 用于向注册中心上报
+func (server *Server) Services() []string {
+	var names []string
+	server.serviceMap.Range(func(name, _ interface{}) bool {
+		names = append(names, name.(string))
+		return true
+	})
+	sort.Strings(names)
+	return names
+}
+
 // 通过RPC调用的入参Service.Method解析得到对应的服务和方法
 func (server *Server) findService(serviceMethod string) (svc *service, mtype *methodType, err error) {
 	dot := strings.LastIndex(serviceMethod, ".")
@@ -244,7 +438,7 @@ func (server *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	// 使用Hijack()获取HTTP连接中的TCP连接 由调用者自己管理 此后只能从conn读写数据
 	conn, _, err := w.(http.Hijacker).Hijack()
 	if err != nil {
-		log.Print("rpc hijacking ", req.RemoteAddr, ": ", err.Error())
+		server.logger.Printf("rpc hijacking %s: %s", req.RemoteAddr, err.Error())
 		return
 	}
 	// 表示连接已经建立
@@ -255,7 +449,7 @@ func (server *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 func (server *Server) HandleHTTP() {
 	http.Handle(defaultRPCPath, server)
 	http.Handle(defaultDebugPath, debugHTTP{server})
-	log.Println("rpc server debug path:", defaultDebugPath)
+	server.logger.Printf("rpc server debug path: %s", defaultDebugPath)
 }
 
 func HandleHTTP() {
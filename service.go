@@ -3,8 +3,12 @@ package geerpc
 import (
 	"go/ast"
 	"log"
+	"math"
 	"reflect"
+	"sort"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
 /* 通过反射实现结构体与服务的映射关系 */
@@ -14,12 +18,83 @@ type methodType struct { // 存储一个方法的完整信息
 	ArgType   reflect.Type
 	ReplyType reflect.Type
 	numCalls  uint64 // 统计方法调用次数
+	numErrors uint64 // 统计方法返回错误的次数
+	inFlight  int64  // 正在执行的调用数
+	latency   latencyStats
 }
 
 func (m *methodType) NumCalls() uint64 {
 	return atomic.LoadUint64(&m.numCalls)
 }
 
+func (m *methodType) NumErrors() uint64 {
+	return atomic.LoadUint64(&m.numErrors)
+}
+
+func (m *methodType) InFlight() int64 {
+	return atomic.LoadInt64(&m.inFlight)
+}
+
+func (m *methodType) AvgLatency() time.Duration {
+	return m.latency.avg()
+}
+
+// p取值(0,1] 例如0.99表示P99 基于最近latencySamples次调用计算
+func (m *methodType) LatencyPercentile(p float64) time.Duration {
+	return m.latency.percentile(p)
+}
+
+const latencySamples = 1024
+
+// 调用耗时统计 平均值基于全部调用 分位数基于最近的latencySamples次调用
+type latencyStats struct {
+	mu      sync.Mutex
+	total   time.Duration
+	count   uint64
+	samples [latencySamples]time.Duration // 环形缓冲区
+	next    int
+}
+
+func (l *latencyStats) add(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.total += d
+	l.count++
+	l.samples[l.next] = d
+	l.next = (l.next + 1) % latencySamples
+}
+
+func (l *latencyStats) avg() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.count == 0 {
+		return 0
+	}
+	return l.total / time.Duration(l.count)
+}
+
+func (l *latencyStats) percentile(p float64) time.Duration {
+	l.mu.Lock()
+	n := latencySamples
+	if l.count < latencySamples {
+		n = int(l.count)
+	}
+	samples := make([]time.Duration, n)
+	copy(samples, l.samples[:n])
+	l.mu.Unlock()
+	if n == 0 {
+		return 0
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	i := int(math.Ceil(p*float64(n))) - 1
+	if i < 0 {
+		i = 0
+	} else if i >= n {
+		i = n - 1
+	}
+	return samples[i]
+}
+
 func (m *methodType) newArgv() reflect.Value {
 	var argv reflect.Value
 	// 服务参数可以是指针类型也可以是值类型
@@ -90,10 +165,19 @@ func (s *service) registerMethods() {
 			ArgType:   argType,
 			ReplyType: replyType,
 		}
-		log.Printf("rpc server: register %s.%s\n", s.name, method.Name)
 	}
 }
 
+// 按名称排序的方法列表
+func (s *service) methodNames() []string {
+	names := make([]string, 0, len(s.method))
+	for name := range s.method {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 func isExportedOrBuiltinType(t reflect.Type) bool {
 	// t.PkgPath()返回定义类型的包路径，对于内置类型返回的是空字符串
 	return ast.IsExported(t.Name()) || t.PkgPath() == ""
@@ -101,9 +185,16 @@ func isExportedOrBuiltinType(t reflect.Type) bool {
 
 func (s *service) call(m *methodType, argv, replyv reflect.Value) error {
 	atomic.AddUint64(&m.numCalls, 1)
+	atomic.AddInt64(&m.inFlight, 1)
+	start := time.Now()
+	defer func() {
+		m.latency.add(time.Since(start))
+		atomic.AddInt64(&m.inFlight, -1)
+	}()
 	f := m.method.Func
 	returnValues := f.Call([]reflect.Value{s.rcvr, argv, replyv})
 	if errInter := returnValues[0].Interface(); errInter != nil {
+		atomic.AddUint64(&m.numErrors, 1)
 		return errInter.(error)
 	}
 	return nil
@@ -0,0 +1,197 @@
+package geerpc
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+/* ****************************************************
+链路追踪：客户端每次调用创建一个client span，服务端在调用
+service.call前后创建server span，二者通过Header中的
+TraceID/SpanID关联，结束的span交给SpanExporter导出
+**************************************************** */
+
+type SpanKind string
+
+const (
+	SpanKindClient   SpanKind = "client"
+	SpanKindServer   SpanKind = "server"
+	SpanKindInternal SpanKind = "internal" // 例如XClient.Broadcast中对每个实例的子span
+)
+
+type Span struct {
+	TraceID  string
+	SpanID   string
+	ParentID string // 根span的ParentID为空
+	Name     string
+	Kind     SpanKind
+	Start    time.Time
+	End      time.Time
+	Error    string
+	Attrs    map[string]string
+
+	tracer   *Tracer
+	mu       sync.Mutex
+	finished bool // 保证一个span只被导出一次
+}
+
+// 给span添加属性 span为nil时什么都不做 方便未开启追踪时直接调用
+func (s *Span) SetAttr(key, value string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Attrs[key] = value
+}
+
+// 结束span并导出 重复调用只有第一次生效
+func (s *Span) Finish(err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.finished {
+		s.mu.Unlock()
+		return
+	}
+	s.finished = true
+	s.End = time.Now()
+	if err != nil {
+		s.Error = err.Error()
+	}
+	exported := s.copyLocked()
+	s.mu.Unlock()
+	s.tracer.exporter.ExportSpan(exported)
+}
+
+// 导出的副本 之后再调用SetAttr不会影响已导出的span 需要持有s.mu
+func (s *Span) copyLocked() *Span {
+	attrs := make(map[string]string, len(s.Attrs))
+	for k, v := range s.Attrs {
+		attrs[k] = v
+	}
+	return &Span{
+		TraceID:  s.TraceID,
+		SpanID:   s.SpanID,
+		ParentID: s.ParentID,
+		Name:     s.Name,
+		Kind:     s.Kind,
+		Start:    s.Start,
+		End:      s.End,
+		Error:    s.Error,
+		Attrs:    attrs,
+		tracer:   s.tracer,
+		finished: true,
+	}
+}
+
+func (s *Span) Duration() time.Duration {
+	return s.End.Sub(s.Start)
+}
+
+// span的导出接口 可以对接日志、Zipkin等不同的后端
+// ExportSpan收到的是span结束时的副本 可以不加锁读取
+type SpanExporter interface {
+	ExportSpan(span *Span)
+}
+
+type Tracer struct {
+	exporter SpanExporter
+}
+
+func NewTracer(exporter SpanExporter) *Tracer {
+	return &Tracer{exporter: exporter}
+}
+
+type spanKey struct{}
+
+// 把span存入context 之后由该context创建的span都作为它的子span
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	if span == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// 创建一个span 若ctx中已有span则作为其子span 否则开启新的调用链
+// tracer为nil表示未开启追踪 返回nil span
+func (t *Tracer) StartSpan(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	var traceID, parentID string
+	if parent := SpanFromContext(ctx); parent != nil {
+		traceID, parentID = parent.TraceID, parent.SpanID
+	}
+	span := t.newSpan(traceID, parentID, name, kind)
+	return ContextWithSpan(ctx, span), span
+}
+
+func (t *Tracer) newSpan(traceID, parentID, name string, kind SpanKind) *Span {
+	if t == nil {
+		return nil
+	}
+	if traceID == "" {
+		traceID = newTraceID()
+	}
+	return &Span{
+		TraceID:  traceID,
+		SpanID:   newSpanID(),
+		ParentID: parentID,
+		Name:     name,
+		Kind:     kind,
+		Start:    time.Now(),
+		Attrs:    make(map[string]string),
+		tracer:   t,
+	}
+}
+
+func newTraceID() string {
+	return fmt.Sprintf("%016x%016x", rand.Uint64(), rand.Uint64())
+}
+
+func newSpanID() string {
+	return fmt.Sprintf("%016x", rand.Uint64())
+}
+
+// 将span保存在内存中的exporter 主要用于测试
+type InMemoryExporter struct {
+	mu    sync.Mutex
+	spans []*Span
+}
+
+var _ SpanExporter = (*InMemoryExporter)(nil)
+
+func NewInMemoryExporter() *InMemoryExporter {
+	return &InMemoryExporter{}
+}
+
+func (e *InMemoryExporter) ExportSpan(span *Span) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, span)
+}
+
+// 返回已导出span的副本 按结束顺序排列
+func (e *InMemoryExporter) Spans() []*Span {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	spans := make([]*Span, len(e.spans))
+	copy(spans, e.spans)
+	return spans
+}
+
+func (e *InMemoryExporter) Reset() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = nil
+}
@@ -0,0 +1,52 @@
+package geerpc
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestTracer_ClientServerSpan(t *testing.T) {
+	exporter := NewInMemoryExporter()
+	tracer := NewTracer(exporter)
+
+	var foo Foo
+	server := NewServer()
+	server.SetTracer(tracer)
+	_ = server.Register(&foo)
+	l, _ := net.Listen("tcp", ":0")
+	defer l.Close()
+	go server.Accept(l)
+
+	client, err := Dial("tcp", l.Addr().String(), &Option{Tracer: tracer})
+	_assert(err == nil, "dial error: %v", err)
+	defer client.Close()
+
+	ctx, root := tracer.StartSpan(context.Background(), "root", SpanKindInternal)
+	var reply int
+	err = client.Call(ctx, "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+	root.Finish(nil)
+	_assert(err == nil && reply == 3, "failed to call Foo.Sum: %v", err)
+
+	spans := make(map[SpanKind]*Span)
+	for _, span := range exporter.Spans() {
+		spans[span.Kind] = span
+	}
+	clientSpan, serverSpan := spans[SpanKindClient], spans[SpanKindServer]
+	_assert(clientSpan != nil && serverSpan != nil, "expect both client and server span")
+	_assert(clientSpan.ParentID == root.SpanID, "client span should be child of root span")
+	_assert(serverSpan.TraceID == root.TraceID, "server span should share trace id %s, got %s", root.TraceID, serverSpan.TraceID)
+	_assert(serverSpan.ParentID == clientSpan.SpanID, "server span should be child of client span")
+}
+
+func TestSpan_ExportCopy(t *testing.T) {
+	exporter := NewInMemoryExporter()
+	tracer := NewTracer(exporter)
+	_, span := tracer.StartSpan(context.Background(), "span", SpanKindInternal)
+	span.SetAttr("a", "1")
+	span.Finish(nil)
+	span.SetAttr("b", "2") // 结束之后的修改不影响已导出的span
+	spans := exporter.Spans()
+	_assert(len(spans) == 1 && spans[0] != span, "expect a copy of the span to be exported")
+	_assert(len(spans[0].Attrs) == 1 && spans[0].Attrs["a"] == "1", "unexpected exported attrs %v", spans[0].Attrs)
+}
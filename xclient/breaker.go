@@ -0,0 +1,206 @@
+package xclient
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+/* ****************************************************
+每个实例地址一个熔断器：
+closed    正常放行 连续失败次数或窗口内错误率超过阈值时打开
+open      拒绝所有请求 经过CoolDown后进入半开
+half-open 放行少量探测请求 成功则关闭 失败则重新打开
+只有连接、超时、过载这类错误计为失败 服务方法返回的业务错误不影响熔断器
+**************************************************** */
+
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+var ErrCircuitOpen = errors.New("rpc xclient: circuit breaker is open")
+
+type BreakerOption struct {
+	ConsecutiveFailures int           // 连续失败达到该次数时打开 0表示不使用
+	ErrorRate           float64       // 窗口内错误率达到该值时打开 取值(0,1] 0表示不使用
+	MinRequests         int           // 窗口内请求数达到该值才计算错误率
+	Window              time.Duration // 统计错误率的时间窗口 默认10s
+	CoolDown            time.Duration // 打开后经过该时间进入半开 默认5s
+	HalfOpenRequests    int           // 半开状态同时允许的探测请求数 默认1
+}
+
+type breaker struct {
+	opt         *BreakerOption
+	mu          sync.Mutex
+	state       BreakerState
+	failures    int // 连续失败次数
+	windowStart time.Time
+	total, errs int // 当前窗口内的请求数和失败数
+	openedAt    time.Time
+	probes      int // 半开状态下正在进行的探测请求数
+}
+
+func newBreaker(opt *BreakerOption) *breaker {
+	return &breaker{opt: opt, windowStart: time.Now()}
+}
+
+// 打开状态经过CoolDown后进入半开 需要持有b.mu
+func (b *breaker) refreshLocked(now time.Time) {
+	if b.state == BreakerOpen && now.Sub(b.openedAt) >= b.opt.CoolDown {
+		b.state = BreakerHalfOpen
+		b.probes = 0
+	}
+}
+
+func (b *breaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refreshLocked(time.Now())
+	return b.state
+}
+
+// 是否可以放行请求 不占用半开状态的探测名额 用于选择实例
+func (b *breaker) ready() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refreshLocked(time.Now())
+	return b.state == BreakerClosed || (b.state == BreakerHalfOpen && b.probes < b.opt.HalfOpenRequests)
+}
+
+// 发送请求前调用 probe表示该请求是半开状态下的探测请求 会占用一个探测名额
+func (b *breaker) acquire() (ok, probe bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refreshLocked(time.Now())
+	switch b.state {
+	case BreakerClosed:
+		return true, false
+	case BreakerHalfOpen:
+		if b.probes < b.opt.HalfOpenRequests {
+			b.probes++
+			return true, true
+		}
+	}
+	return false, false
+}
+
+// 记录请求结果 返回当前状态以及状态是否发生变化
+func (b *breaker) record(failed, probe bool) (BreakerState, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	if probe {
+		b.probes--
+		if b.state != BreakerHalfOpen { // 其他探测请求已经决定了状态
+			return b.state, false
+		}
+		if failed {
+			b.open(now)
+		} else {
+			b.reset(now)
+		}
+		return b.state, true
+	}
+	if b.state != BreakerClosed { // 打开前发出的请求 结果不再统计
+		return b.state, false
+	}
+	if now.Sub(b.windowStart) >= b.opt.Window {
+		b.windowStart, b.total, b.errs = now, 0, 0
+	}
+	b.total++
+	if !failed {
+		b.failures = 0
+		return b.state, false
+	}
+	b.errs++
+	b.failures++
+	if (b.opt.ConsecutiveFailures > 0 && b.failures >= b.opt.ConsecutiveFailures) ||
+		(b.opt.ErrorRate > 0 && b.total >= b.opt.MinRequests && float64(b.errs)/float64(b.total) >= b.opt.ErrorRate) {
+		b.open(now)
+		return b.state, true
+	}
+	return b.state, false
+}
+
+func (b *breaker) open(now time.Time) {
+	b.state = BreakerOpen
+	b.openedAt = now
+}
+
+func (b *breaker) reset(now time.Time) {
+	b.state = BreakerClosed
+	b.failures, b.total, b.errs = 0, 0, 0
+	b.windowStart = now
+}
+
+// 开启熔断 需要在发起调用之前设置 nil表示不开启
+func (xc *XClient) SetBreakerOption(opt *BreakerOption) {
+	if opt == nil {
+		xc.breakerOpt = nil
+		return
+	}
+	o := *opt
+	if o.Window <= 0 {
+		o.Window = time.Second * 10
+	}
+	if o.CoolDown <= 0 {
+		o.CoolDown = time.Second * 5
+	}
+	if o.HalfOpenRequests <= 0 {
+		o.HalfOpenRequests = 1
+	}
+	xc.breakerOpt = &o
+}
+
+// 获取地址对应的熔断器 未开启熔断时返回nil
+func (xc *XClient) breaker(rpcAddr string) *breaker {
+	if xc.breakerOpt == nil {
+		return nil
+	}
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	b, ok := xc.breakers[rpcAddr]
+	if !ok {
+		b = newBreaker(xc.breakerOpt)
+		xc.breakers[rpcAddr] = b
+	}
+	return b
+}
+
+// 实例是否可以接收请求 用于选择实例时跳过熔断的实例
+func (xc *XClient) available(rpcAddr string) bool {
+	b := xc.breaker(rpcAddr)
+	return b == nil || b.ready()
+}
+
+// 各个实例熔断器的当前状态
+func (xc *XClient) BreakerStates() map[string]BreakerState {
+	xc.mu.Lock()
+	breakers := make(map[string]*breaker, len(xc.breakers))
+	for addr, b := range xc.breakers {
+		breakers[addr] = b
+	}
+	xc.mu.Unlock()
+	states := make(map[string]BreakerState, len(breakers))
+	for addr, b := range breakers {
+		states[addr] = b.State()
+	}
+	return states
+}
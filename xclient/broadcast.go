@@ -0,0 +1,138 @@
+package xclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	. "geerpc"
+	"reflect"
+)
+
+/* ****************************************************
+Broadcast的几种变体：
+BroadcastAll    等待所有实例返回 每个实例的结果和错误分别返回
+BroadcastQuorum 有n个实例成功后取消其余的调用
+Fork            使用第一个成功的结果 取消其余的调用
+**************************************************** */
+
+// 一个实例的调用结果 Reply与传入的reply类型相同
+type BroadcastResult struct {
+	Reply interface{}
+	Error error
+	seq   int // 完成的顺序 从1开始 0表示没有等到结果 用于Fork选择最先出现的结果
+}
+
+// 向所有实例调用指定的方法 reply只用于确定返回值的类型 返回每个实例的结果 实例地址 - 结果
+// 只有获取实例列表失败时返回错误 各个实例的错误在结果中
+func (xc *XClient) BroadcastAll(ctx context.Context, serviceMethod string, args, reply interface{}) (map[string]*BroadcastResult, error) {
+	return xc.scatter(ctx, "BroadcastAll", serviceMethod, args, reply, 0)
+}
+
+// 向所有实例调用指定的方法 有n个实例成功后取消其余的调用
+// 成功的实例不足n个时返回错误 结果中包含所有实例 被取消的调用的错误为ctx取消的错误
+func (xc *XClient) BroadcastQuorum(ctx context.Context, serviceMethod string, args, reply interface{}, n int) (map[string]*BroadcastResult, error) {
+	results, err := xc.scatter(ctx, "BroadcastQuorum", serviceMethod, args, reply, n)
+	if err != nil {
+		return nil, err
+	}
+	if succeeded := countSucceeded(results); succeeded < n {
+		return results, fmt.Errorf("rpc xclient: quorum not reached, %d of %d servers succeeded, need %d", succeeded, len(results), n)
+	}
+	return results, nil
+}
+
+// 向所有实例调用指定的方法 把第一个成功的结果写入reply并取消其余的调用 所有实例都失败时返回第一个错误
+func (xc *XClient) Fork(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	results, err := xc.scatter(ctx, "Fork", serviceMethod, args, reply, 1)
+	if err != nil {
+		return err
+	}
+	var first, firstErr *BroadcastResult // 最先成功的结果和最先出现的错误
+	for _, r := range results {
+		if r.seq == 0 { // 被取消而没有等到的调用
+			continue
+		}
+		if r.Error == nil && (first == nil || r.seq < first.seq) {
+			first = r
+		}
+		if r.Error != nil && (firstErr == nil || r.seq < firstErr.seq) {
+			firstErr = r
+		}
+	}
+	if first != nil {
+		if reply != nil {
+			reflect.ValueOf(reply).Elem().Set(reflect.ValueOf(first.Reply).Elem())
+		}
+		return nil
+	}
+	if firstErr == nil {
+		return errors.New("rpc xclient: no available servers")
+	}
+	return firstErr.Error
+}
+
+func countSucceeded(results map[string]*BroadcastResult) int {
+	n := 0
+	for _, r := range results {
+		if r.Error == nil {
+			n++
+		}
+	}
+	return n
+}
+
+type scatterResult struct {
+	rpcAddr string
+	result  *BroadcastResult
+}
+
+// 并发调用所有实例 need大于0时成功的实例数达到need后立即返回并取消其余的调用 need为0时等待所有实例
+// 没有等到的实例的错误为ctx取消的错误 它们的结果写入带缓冲的channel后丢弃
+func (xc *XClient) scatter(ctx context.Context, name, serviceMethod string, args, reply interface{}, need int) (map[string]*BroadcastResult, error) {
+	ctx, span := xc.tracer().StartSpan(ctx, name+" "+serviceMethod, SpanKindInternal)
+	servers, err := xc.d.GetAll()
+	if err != nil {
+		span.Finish(err)
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	done := make(chan scatterResult, len(servers))
+	for _, rpcAddr := range servers {
+		go func(rpcAddr string) {
+			var clonedReply interface{}
+			if reply != nil {
+				clonedReply = reflect.New(reflect.ValueOf(reply).Elem().Type()).Interface()
+			}
+			ctx, child := xc.tracer().StartSpan(ctx, rpcAddr, SpanKindInternal)
+			child.SetAttr("peer.addr", rpcAddr)
+			err := xc.call(rpcAddr, ctx, serviceMethod, args, clonedReply)
+			child.Finish(err)
+			done <- scatterResult{rpcAddr: rpcAddr, result: &BroadcastResult{Reply: clonedReply, Error: err}}
+		}(rpcAddr)
+	}
+	results := make(map[string]*BroadcastResult, len(servers))
+	succeeded := 0
+	for finished := 0; finished < len(servers) && (need <= 0 || succeeded < need); {
+		r := <-done
+		finished++
+		r.result.seq = finished
+		results[r.rpcAddr] = r.result
+		if r.result.Error == nil {
+			succeeded++
+		}
+	}
+	cancel()
+	for _, rpcAddr := range servers {
+		if _, ok := results[rpcAddr]; !ok {
+			results[rpcAddr] = &BroadcastResult{Error: ctx.Err()}
+		}
+	}
+	if need > 0 && succeeded < need {
+		span.Finish(fmt.Errorf("%d of %d servers succeeded", succeeded, len(servers)))
+	} else {
+		span.Finish(nil)
+	}
+	return results, nil
+}
@@ -0,0 +1,82 @@
+package xclient
+
+import (
+	"context"
+	"hash/crc32"
+	"sort"
+	"strconv"
+)
+
+/* ****************************************************
+一致性哈希：每个实例在哈希环上对应多个虚拟节点，key顺时针找到的
+第一个虚拟节点所属的实例即为选中的实例，实例增减时只影响少量key
+**************************************************** */
+
+type Hash func(data []byte) uint32
+
+const defaultReplicas = 50
+
+type hashRing struct {
+	hash  Hash
+	keys  []int          // 已排序的虚拟节点哈希值
+	nodes map[int]string // 虚拟节点哈希值 - 实例地址
+}
+
+// 每个实例的虚拟节点数为replicas乘以权重
+func newHashRing(hash Hash, replicas int, servers []string, weight func(string) int) *hashRing {
+	r := &hashRing{hash: hash, nodes: make(map[int]string)}
+	for _, s := range servers {
+		for i := 0; i < replicas*weight(s); i++ {
+			h := int(r.hash([]byte(strconv.Itoa(i) + s)))
+			r.keys = append(r.keys, h)
+			r.nodes[h] = s
+		}
+	}
+	sort.Ints(r.keys)
+	return r
+}
+
+func (r *hashRing) get(key string) string {
+	if len(r.keys) == 0 {
+		return ""
+	}
+	h := int(r.hash([]byte(key)))
+	i := sort.Search(len(r.keys), func(i int) bool { return r.keys[i] >= h })
+	return r.nodes[r.keys[i%len(r.keys)]] // 超过最大值时回到环的起点
+}
+
+// 支持按key选择实例的Discovery 用于ConsistentHashSelect
+type KeyDiscovery interface {
+	Discovery
+	GetByKey(key string) (string, error)
+}
+
+type hashKeyCtx struct{}
+
+// 设置本次调用用于一致性哈希的key 优先于XClient.SetHashKeyFunc
+func WithHashKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, hashKeyCtx{}, key)
+}
+
+func hashKeyFromContext(ctx context.Context) (string, bool) {
+	key, ok := ctx.Value(hashKeyCtx{}).(string)
+	return key, ok
+}
+
+// 设置从调用参数计算一致性哈希key的函数 ctx中没有key时使用
+func (xc *XClient) SetHashKeyFunc(f func(serviceMethod string, args interface{}) string) {
+	xc.hashKeyFunc = f
+}
+
+// ConsistentHashSelect模式下把key放入ctx 供选择实例时使用
+func (xc *XClient) withHashKey(ctx context.Context, serviceMethod string, args interface{}) context.Context {
+	if xc.mode != ConsistentHashSelect {
+		return ctx
+	}
+	if _, ok := hashKeyFromContext(ctx); ok || xc.hashKeyFunc == nil {
+		return ctx
+	}
+	return WithHashKey(ctx, xc.hashKeyFunc(serviceMethod, args))
+}
+
+var defaultHash Hash = crc32.ChecksumIEEE
@@ -11,8 +11,13 @@ import (
 type SelectMode int // 表示不同的负载均衡策略
 
 const (
-	RandomSelect     SelectMode = iota // 随机选择
-	RoundRobinSelect                   // 轮询
+	RandomSelect             SelectMode = iota // 随机选择
+	RoundRobinSelect                           // 轮询
+	WeightedRoundRobinSelect                   // 平滑加权轮询 与nginx的实现相同
+	WeightedRandomSelect                       // 加权随机
+	ConsistentHashSelect                       // 一致性哈希 需要Discovery实现KeyDiscovery
+	LeastActiveSelect                          // 正在进行的请求数最少 需要Discovery实现StatsDiscovery
+	P2CSelect                                  // 随机两个实例中延迟EWMA和请求数较低的一个 需要Discovery实现StatsDiscovery
 )
 
 type Discovery interface {
@@ -22,39 +27,211 @@ type Discovery interface {
 	GetAll() ([]string, error)           // 获取所有服务实例
 }
 
+// 服务列表变化时通知订阅者的Discovery XClient借此关闭已经下线的实例的连接
+type WatchDiscovery interface {
+	Discovery
+	OnChange(f func(servers []string)) (cancel func()) // f在服务列表变化后被调用 返回取消订阅的函数
+}
+
 // 手工维护服务列表，不需要注册中心的服务发现结构体
 type MultiServerDiscovery struct {
-	r       *rand.Rand // 获取随机数
-	mu      sync.RWMutex
-	servers []string
-	index   int // 用于轮询策略 记录已经轮询到的位置
+	r        *rand.Rand // 获取随机数
+	mu       sync.RWMutex
+	servers  []string
+	index    int            // 用于轮询策略 记录已经轮询到的位置
+	weights  map[string]int // 实例的权重 未设置或不大于0时为1
+	current  map[string]int // 平滑加权轮询中每个实例的当前权重
+	hash     Hash
+	replicas int       // 一致性哈希中每个实例（权重为1时）的虚拟节点数
+	ring     *hashRing // 实例列表或权重变化后置为nil 下次使用时重建
+
+	listenerMu   sync.Mutex // 通知订阅者时不持有mu 避免回调中访问Discovery时死锁
+	listeners    map[int]func(servers []string)
+	nextListener int
 }
 
 func NewMultiServerDiscovery(servers []string) *MultiServerDiscovery {
 	d := &MultiServerDiscovery{
-		servers: servers,
-		r:       rand.New(rand.NewSource(time.Now().UnixNano())),
+		servers:  servers,
+		r:        rand.New(rand.NewSource(time.Now().UnixNano())),
+		hash:     defaultHash,
+		replicas: defaultReplicas,
 	}
 	d.index = d.r.Intn(math.MaxInt32 - 1) // 初始化一个随机值 避免每次从0开始
 	return d
 }
 
-var _ Discovery = (*MultiServerDiscovery)(nil)
+var (
+	_ KeyDiscovery   = (*MultiServerDiscovery)(nil)
+	_ StatsDiscovery = (*MultiServerDiscovery)(nil)
+	_ WatchDiscovery = (*MultiServerDiscovery)(nil)
+)
 
 func (d *MultiServerDiscovery) Refresh() error {
 	return nil
 }
 
 func (d *MultiServerDiscovery) Update(servers []string) error {
+	if d.setServers(servers) {
+		d.notify(servers)
+	}
+	return nil
+}
+
+// 更新实例列表但不通知订阅者 返回列表是否发生变化
+func (d *MultiServerDiscovery) setServers(servers []string) bool {
 	d.mu.Lock()
 	defer d.mu.Unlock()
+	return d.setServersLocked(servers)
+}
+
+// 更新实例列表 返回列表是否发生变化 需要持有d.mu
+func (d *MultiServerDiscovery) setServersLocked(servers []string) bool {
+	changed := !equalStrings(d.servers, servers)
 	d.servers = servers // slice非线程安全
+	d.resetLocked()
+	return changed
+}
+
+func (d *MultiServerDiscovery) OnChange(f func(servers []string)) (cancel func()) {
+	d.listenerMu.Lock()
+	defer d.listenerMu.Unlock()
+	if d.listeners == nil {
+		d.listeners = make(map[int]func(servers []string))
+	}
+	id := d.nextListener
+	d.nextListener++
+	d.listeners[id] = f
+	return func() {
+		d.listenerMu.Lock()
+		defer d.listenerMu.Unlock()
+		delete(d.listeners, id)
+	}
+}
+
+// 通知订阅者服务列表发生了变化 不能持有d.mu
+func (d *MultiServerDiscovery) notify(servers []string) {
+	d.listenerMu.Lock()
+	listeners := make([]func([]string), 0, len(d.listeners))
+	for _, f := range d.listeners {
+		listeners = append(listeners, f)
+	}
+	d.listenerMu.Unlock()
+	for _, f := range listeners {
+		f(append([]string(nil), servers...))
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// 实例列表或权重变化后 重置加权轮询和一致性哈希的状态 需要持有d.mu
+func (d *MultiServerDiscovery) resetLocked() {
+	d.current = nil
+	d.ring = nil
+}
+
+// 手动设置实例的权重 用于加权的负载均衡策略
+func (d *MultiServerDiscovery) UpdateWeights(weights map[string]int) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.weights = weights
+	d.resetLocked()
 	return nil
 }
 
-func (d *MultiServerDiscovery) Get(mode SelectMode) (string, error) {
-	d.mu.RLock() // 并发情况下slice非线程安全
+// 获取实例的权重 返回的是副本
+func (d *MultiServerDiscovery) Weights() map[string]int {
+	d.mu.RLock()
 	defer d.mu.RUnlock()
+	weights := make(map[string]int, len(d.weights))
+	for s, w := range d.weights {
+		weights[s] = w
+	}
+	return weights
+}
+
+// 设置一致性哈希的虚拟节点数和哈希函数 replicas不大于0或hash为nil时使用默认值
+func (d *MultiServerDiscovery) SetHashRing(replicas int, hash Hash) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if replicas <= 0 {
+		replicas = defaultReplicas
+	}
+	if hash == nil {
+		hash = defaultHash
+	}
+	d.replicas, d.hash = replicas, hash
+	d.ring = nil
+}
+
+// 按一致性哈希选择key对应的实例
+func (d *MultiServerDiscovery) GetByKey(key string) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.servers) == 0 {
+		return "", errors.New("rpc discovery: no available servers")
+	}
+	if d.ring == nil {
+		d.ring = newHashRing(d.hash, d.replicas, d.servers, d.weight)
+	}
+	return d.ring.get(key), nil
+}
+
+// 需要持有d.mu
+func (d *MultiServerDiscovery) weight(server string) int {
+	if w := d.weights[server]; w > 0 {
+		return w
+	}
+	return 1
+}
+
+// 平滑加权轮询：每次选择时所有实例的当前权重加上各自的权重，选出当前权重最大的实例，
+// 再将其当前权重减去权重总和 这样权重高的实例不会被连续选中 需要持有d.mu
+func (d *MultiServerDiscovery) smoothWeighted() string {
+	if d.current == nil {
+		d.current = make(map[string]int)
+	}
+	total, best := 0, ""
+	for _, s := range d.servers {
+		w := d.weight(s)
+		total += w
+		d.current[s] += w
+		if best == "" || d.current[s] > d.current[best] {
+			best = s
+		}
+	}
+	d.current[best] -= total
+	return best
+}
+
+// 需要持有d.mu
+func (d *MultiServerDiscovery) weightedRandom() string {
+	total := 0
+	for _, s := range d.servers {
+		total += d.weight(s)
+	}
+	n := d.r.Intn(total)
+	for _, s := range d.servers {
+		if n -= d.weight(s); n < 0 {
+			return s
+		}
+	}
+	return d.servers[len(d.servers)-1]
+}
+
+func (d *MultiServerDiscovery) Get(mode SelectMode) (string, error) {
+	d.mu.Lock() // 并发情况下slice非线程安全 且轮询会修改index、rand.Rand也非线程安全 因此使用写锁
+	defer d.mu.Unlock()
 
 	n := len(d.servers)
 	if n == 0 {
@@ -67,6 +244,14 @@ func (d *MultiServerDiscovery) Get(mode SelectMode) (string, error) {
 		s := d.servers[d.index%n]
 		d.index = (d.index + 1) % n
 		return s, nil
+	case WeightedRoundRobinSelect:
+		return d.smoothWeighted(), nil
+	case WeightedRandomSelect:
+		return d.weightedRandom(), nil
+	case ConsistentHashSelect:
+		return "", errors.New("rpc discovery: consistent hash select requires a key, use GetByKey")
+	case LeastActiveSelect, P2CSelect:
+		return "", errors.New("rpc discovery: least active and p2c select require client stats, use GetByStats")
 	default:
 		return "", errors.New("rpc discovery: not supported select mode")
 	}
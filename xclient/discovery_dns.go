@@ -0,0 +1,215 @@
+package xclient
+
+import (
+	"context"
+	"errors"
+	. "geerpc"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* ****************************************************
+通过DNS解析服务地址，不需要注册中心：
+NewDNSDiscovery     解析host的A/AAAA记录 每个IP加上固定的端口作为一个实例
+NewDNSSRVDiscovery  解析SRV记录 使用优先级最高（Priority最小）的一组记录 SRV的Weight作为实例的权重
+第一次获取服务实例时开始在后台每隔Interval重新解析，解析失败时保留之前的服务列表
+解析通过Resolver接口完成 默认为net.DefaultResolver 测试时可以替换为固定的结果
+**************************************************** */
+
+// 解析服务地址 方法与*net.Resolver相同
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) (addrs []string, err error)
+	LookupSRV(ctx context.Context, service, proto, name string) (cname string, addrs []*net.SRV, err error)
+}
+
+var _ Resolver = net.DefaultResolver
+
+type DNSOption struct {
+	Resolver Resolver      // 为nil时使用net.DefaultResolver
+	Interval time.Duration // 重新解析的间隔 默认30s
+	Timeout  time.Duration // 每次解析的超时时间 默认5s
+	Protocol string        // 实例地址的协议 默认tcp 实例地址为protocol@host:port
+}
+
+type DNSDiscovery struct {
+	*MultiServerDiscovery
+	target    string
+	opt       DNSOption
+	lookup    func(ctx context.Context) (servers []string, weights map[string]int, err error)
+	logger    Logger
+	startOnce sync.Once
+	ready     chan struct{}
+	readyOnce sync.Once
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+var _ WatchDiscovery = (*DNSDiscovery)(nil)
+
+// target为host:port 解析host得到的每个IP为一个实例 第一次获取服务实例时开始解析 需要调用Close停止解析
+func NewDNSDiscovery(target string, opt *DNSOption) (*DNSDiscovery, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	d := newDNSDiscovery(target, opt)
+	d.lookup = func(ctx context.Context) ([]string, map[string]int, error) {
+		ips, err := d.opt.Resolver.LookupHost(ctx, host)
+		if err != nil {
+			return nil, nil, err
+		}
+		servers := make([]string, 0, len(ips))
+		for _, ip := range ips {
+			servers = append(servers, d.opt.Protocol+"@"+net.JoinHostPort(ip, port))
+		}
+		return servers, nil, nil
+	}
+	return d, nil
+}
+
+// name为SRV记录的完整名字 如_geerpc._tcp.example.com 第一次获取服务实例时开始解析 需要调用Close停止解析
+func NewDNSSRVDiscovery(name string, opt *DNSOption) (*DNSDiscovery, error) {
+	if name == "" {
+		return nil, errors.New("rpc discovery: missing SRV name")
+	}
+	d := newDNSDiscovery(name, opt)
+	d.lookup = func(ctx context.Context) ([]string, map[string]int, error) {
+		_, records, err := d.opt.Resolver.LookupSRV(ctx, "", "", name)
+		if err != nil {
+			return nil, nil, err
+		}
+		servers := make([]string, 0, len(records))
+		weights := make(map[string]int, len(records))
+		var priority uint16
+		for i, srv := range records {
+			if i == 0 || srv.Priority < priority {
+				priority = srv.Priority
+			}
+		}
+		for _, srv := range records {
+			if srv.Priority != priority {
+				continue
+			}
+			host := strings.TrimSuffix(srv.Target, ".")
+			server := d.opt.Protocol + "@" + net.JoinHostPort(host, strconv.Itoa(int(srv.Port)))
+			servers = append(servers, server)
+			weights[server] = int(srv.Weight)
+		}
+		return servers, weights, nil
+	}
+	return d, nil
+}
+
+func newDNSDiscovery(target string, opt *DNSOption) *DNSDiscovery {
+	var o DNSOption
+	if opt != nil {
+		o = *opt
+	}
+	if o.Resolver == nil {
+		o.Resolver = net.DefaultResolver
+	}
+	if o.Interval <= 0 {
+		o.Interval = time.Second * 30
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = time.Second * 5
+	}
+	if o.Protocol == "" {
+		o.Protocol = "tcp"
+	}
+	return &DNSDiscovery{
+		MultiServerDiscovery: NewMultiServerDiscovery(make([]string, 0)),
+		target:               target,
+		opt:                  o,
+		logger:               DefaultLogger,
+		ready:                make(chan struct{}),
+		closed:               make(chan struct{}),
+	}
+}
+
+// 设置日志输出 nil表示丢弃所有日志 需要在获取服务实例之前设置
+func (d *DNSDiscovery) SetLogger(logger Logger) {
+	if logger == nil {
+		logger = NopLogger
+	}
+	d.logger = logger
+}
+
+func (d *DNSDiscovery) resolve() {
+	t := time.NewTicker(d.opt.Interval)
+	defer t.Stop()
+	for {
+		if err := d.Refresh(); err != nil {
+			d.logger.Printf("rpc discovery: resolve %s err: %v", d.target, err)
+		}
+		d.readyOnce.Do(func() { close(d.ready) }) // 第一次解析失败时不再让Get等待
+		select {
+		case <-d.closed:
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (d *DNSDiscovery) start() {
+	d.startOnce.Do(func() { go d.resolve() })
+}
+
+// 立即重新解析一次 一般不需要调用
+func (d *DNSDiscovery) Refresh() error {
+	ctx, cancel := context.WithTimeout(context.Background(), d.opt.Timeout)
+	defer cancel()
+	servers, weights, err := d.lookup(ctx)
+	if err != nil {
+		return err
+	}
+	sort.Strings(servers)
+	d.mu.Lock()
+	changed := d.setServersLocked(servers)
+	d.weights = weights
+	d.mu.Unlock()
+	if changed {
+		d.logger.Printf("rpc discovery: servers of %s changed to %v", d.target, servers)
+		d.notify(servers)
+	}
+	return nil
+}
+
+// 开始解析并等待第一次解析完成
+func (d *DNSDiscovery) waitReady() {
+	d.start()
+	select {
+	case <-d.ready:
+	case <-d.closed:
+	}
+}
+
+func (d *DNSDiscovery) Get(mode SelectMode) (string, error) {
+	d.waitReady()
+	return d.MultiServerDiscovery.Get(mode)
+}
+
+func (d *DNSDiscovery) GetByKey(key string) (string, error) {
+	d.waitReady()
+	return d.MultiServerDiscovery.GetByKey(key)
+}
+
+func (d *DNSDiscovery) GetByStats(mode SelectMode, stats LoadStats) (string, error) {
+	d.waitReady()
+	return d.MultiServerDiscovery.GetByStats(mode, stats)
+}
+
+func (d *DNSDiscovery) GetAll() ([]string, error) {
+	d.waitReady()
+	return d.MultiServerDiscovery.GetAll()
+}
+
+// 停止解析
+func (d *DNSDiscovery) Close() error {
+	d.closeOnce.Do(func() { close(d.closed) })
+	return nil
+}
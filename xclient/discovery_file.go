@@ -0,0 +1,182 @@
+package xclient
+
+import (
+	"encoding/json"
+	"errors"
+	. "geerpc"
+	"geerpc/registry"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+/* ****************************************************
+从本地文件读取服务列表，不需要注册中心，用于测试和预发环境。
+文件格式与注册中心以JSON返回的查询结果相同（只支持JSON 避免引入YAML的依赖）：
+{"servers": [{"addr": "tcp@127.0.0.1:9999", "weight": 2, "zone": "z1", "tags": ["canary"]}]}
+后台定期检查文件的修改时间和大小，变化后重新读取，读取失败时保留之前的服务列表
+**************************************************** */
+
+type FileDiscovery struct {
+	*MultiServerDiscovery
+	registryMeta
+	path      string
+	interval  time.Duration
+	logger    Logger
+	fileMu    sync.Mutex // 保护modTime和size
+	modTime   time.Time
+	size      int64
+	startOnce sync.Once
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+const defaultFileInterval = time.Second * 5
+
+var _ WatchDiscovery = (*FileDiscovery)(nil)
+
+// 读取path中的服务列表 文件不存在或格式错误时返回错误
+// 第一次获取服务实例时开始每隔interval检查文件 interval为0时默认5s 需要调用Close停止检查
+func NewFileDiscovery(path string, interval time.Duration) (*FileDiscovery, error) {
+	if interval <= 0 {
+		interval = defaultFileInterval
+	}
+	d := &FileDiscovery{
+		MultiServerDiscovery: NewMultiServerDiscovery(make([]string, 0)),
+		path:                 path,
+		interval:             interval,
+		logger:               DefaultLogger,
+		closed:               make(chan struct{}),
+	}
+	if _, err := d.load(true); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// 设置日志输出 nil表示丢弃所有日志 需要在获取服务实例之前设置
+func (d *FileDiscovery) SetLogger(logger Logger) {
+	if logger == nil {
+		logger = NopLogger
+	}
+	d.logger = logger
+}
+
+// 文件变化或force为true时重新读取 返回是否重新读取了文件
+func (d *FileDiscovery) load(force bool) (bool, error) {
+	d.fileMu.Lock()
+	defer d.fileMu.Unlock()
+	info, err := os.Stat(d.path)
+	if err != nil {
+		return false, err
+	}
+	if !force && info.ModTime().Equal(d.modTime) && info.Size() == d.size {
+		return false, nil
+	}
+	data, err := ioutil.ReadFile(d.path)
+	if err != nil {
+		return false, err
+	}
+	var result registry.QueryResult
+	if err := json.Unmarshal(data, &result); err != nil {
+		return false, err
+	}
+	for _, item := range result.Servers {
+		if item.Addr == "" {
+			return false, errors.New("rpc discovery: missing server address in " + d.path)
+		}
+	}
+	d.modTime, d.size = info.ModTime(), info.Size()
+	d.apply(&result)
+	return true, nil
+}
+
+// 按标签过滤后更新服务列表
+func (d *FileDiscovery) apply(result *registry.QueryResult) {
+	d.metaMu.RLock()
+	tags := d.tags
+	d.metaMu.RUnlock()
+	filtered := &registry.QueryResult{}
+	for _, item := range result.Servers {
+		matched := true
+		for _, tag := range tags {
+			matched = matched && item.HasTag(tag)
+		}
+		if matched {
+			filtered.Servers = append(filtered.Servers, item)
+		}
+	}
+	sort.Slice(filtered.Servers, func(i, j int) bool { return filtered.Servers[i].Addr < filtered.Servers[j].Addr })
+	list := newServerList(filtered)
+	d.mu.Lock()
+	changed := d.setServersLocked(list.servers)
+	d.weights = list.weights
+	d.mu.Unlock()
+	d.setItems(list.items)
+	if changed {
+		d.notify(list.servers)
+	}
+}
+
+// 只使用带有所有指定标签的实例 立即重新读取文件
+func (d *FileDiscovery) SetTags(tags ...string) {
+	d.registryMeta.SetTags(tags...)
+	if _, err := d.load(true); err != nil {
+		d.logger.Printf("rpc discovery: load %s err: %v", d.path, err)
+	}
+}
+
+func (d *FileDiscovery) watch() {
+	t := time.NewTicker(d.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-d.closed:
+			return
+		case <-t.C:
+		}
+		if reloaded, err := d.load(false); err != nil {
+			d.logger.Printf("rpc discovery: load %s err: %v", d.path, err)
+		} else if reloaded {
+			d.logger.Printf("rpc discovery: reload servers from %s", d.path)
+		}
+	}
+}
+
+func (d *FileDiscovery) start() {
+	d.startOnce.Do(func() { go d.watch() })
+}
+
+// 立即检查文件是否变化 一般不需要调用
+func (d *FileDiscovery) Refresh() error {
+	_, err := d.load(false)
+	return err
+}
+
+func (d *FileDiscovery) Get(mode SelectMode) (string, error) {
+	d.start()
+	return d.MultiServerDiscovery.Get(mode)
+}
+
+func (d *FileDiscovery) GetByKey(key string) (string, error) {
+	d.start()
+	return d.MultiServerDiscovery.GetByKey(key)
+}
+
+func (d *FileDiscovery) GetByStats(mode SelectMode, stats LoadStats) (string, error) {
+	d.start()
+	return d.MultiServerDiscovery.GetByStats(mode, stats)
+}
+
+func (d *FileDiscovery) GetAll() ([]string, error) {
+	d.start()
+	return d.MultiServerDiscovery.GetAll()
+}
+
+// 停止检查文件
+func (d *FileDiscovery) Close() error {
+	d.closeOnce.Do(func() { close(d.closed) })
+	return nil
+}
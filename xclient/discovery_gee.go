@@ -1,63 +1,260 @@
 package xclient
 
 import (
-	"log"
+	"context"
+	"encoding/json"
+	"fmt"
+	. "geerpc"
+	"geerpc/registry"
 	"net/http"
+	"net/url"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type GeeRegistryDiscovery struct {
 	*MultiServerDiscovery
-	registry   string        // 注册中心地址
+	registryMeta
+	registry   string        // 去掉token的注册中心地址 用于日志
 	timeout    time.Duration // 服务实例的过期时间
 	lastUpdate time.Time     // 最后从注册中心获取服务列表的时间 默认每隔10s从注册中心获取
+	logger     Logger
+	refreshMu  sync.Mutex // 保证同一时间只有一个goroutine请求注册中心
+	refreshing int32      // 是否正在请求注册中心 原子操作
 }
 
 const defaultUpdateTimeout = time.Second * 10
 
+// registryAddr可以是以逗号分隔的多个注册中心地址（集群中的多个节点） 请求失败时依次尝试下一个
+// 注册中心开启了认证时 token放在地址中 例如http://:token@host:port/_geerpc_/registry
 func NewGeeRegistryDiscovery(registryAddr string, timeout time.Duration) *GeeRegistryDiscovery {
 	if timeout == 0 {
 		timeout = defaultUpdateTimeout
 	}
 	return &GeeRegistryDiscovery{
 		MultiServerDiscovery: NewMultiServerDiscovery(make([]string, 0)),
-		registry:             registryAddr,
+		registryMeta:         registryMeta{registries: strings.Split(registryAddr, ",")},
+		registry:             registry.RedactToken(registryAddr),
 		timeout:              timeout,
+		logger:               DefaultLogger,
 	}
 }
 
+// 只获取提供指定服务的实例 registryAddr中可以带上namespace参数指定命名空间
+func NewGeeRegistryDiscoveryForService(registryAddr, service string, timeout time.Duration) *GeeRegistryDiscovery {
+	return NewGeeRegistryDiscovery(withQuery(registryAddr, "service", service), timeout)
+}
+
+// 在URL中设置查询参数 rawURL可以是以逗号分隔的多个URL URL不合法时原样返回 请求时会报错
+func withQuery(rawURL, key, value string) string {
+	urls := strings.Split(rawURL, ",")
+	for i, raw := range urls {
+		u, err := url.Parse(raw)
+		if err != nil {
+			continue
+		}
+		q := u.Query()
+		q.Set(key, value)
+		u.RawQuery = q.Encode()
+		urls[i] = u.String()
+	}
+	return strings.Join(urls, ",")
+}
+
+// 设置日志输出 nil表示丢弃所有日志
+func (d *GeeRegistryDiscovery) SetLogger(logger Logger) {
+	if logger == nil {
+		logger = NopLogger
+	}
+	d.logger = logger
+}
+
 func (d *GeeRegistryDiscovery) Update(servers []string) error {
 	d.mu.Lock()
-	defer d.mu.Unlock()
-	d.servers = servers
+	changed := d.setServersLocked(servers)
 	d.lastUpdate = time.Now()
+	d.mu.Unlock()
+	if changed {
+		d.notify(servers)
+	}
 	return nil
 }
 
+// 请求注册中心时不持有d.mu 避免阻塞Get 同一时间只有一个goroutine请求注册中心
+// 已经有实例时其他goroutine不等待请求结果 先使用旧的服务列表
 func (d *GeeRegistryDiscovery) Refresh() error {
-	d.mu.Lock()
-	defer d.mu.Unlock()
-	if d.lastUpdate.Add(d.timeout).After(time.Now()) { // 未超时
+	d.mu.RLock()
+	fresh := d.lastUpdate.Add(d.timeout).After(time.Now())
+	hasServers := len(d.servers) > 0
+	d.mu.RUnlock()
+	if fresh || (hasServers && atomic.LoadInt32(&d.refreshing) == 1) {
 		return nil
 	}
-	log.Println("rpc registry: refresh servers from registry", d.registry)
-	resp, err := http.Get(d.registry)
+	d.refreshMu.Lock()
+	defer d.refreshMu.Unlock()
+	d.mu.RLock()
+	fresh = d.lastUpdate.Add(d.timeout).After(time.Now()) // 等待期间其他goroutine可能已经更新
+	d.mu.RUnlock()
+	if fresh {
+		return nil
+	}
+	atomic.StoreInt32(&d.refreshing, 1)
+	defer atomic.StoreInt32(&d.refreshing, 0)
+
+	d.logger.Printf("rpc registry: refresh servers from registry %s", d.registry)
+	list, err := d.fetch(context.Background(), nil, nil)
 	if err != nil {
-		log.Println("rpc registry refresh err:", err)
+		d.logger.Printf("rpc registry refresh err: %v", err)
 		return err
 	}
-	servers := strings.Split(resp.Header.Get("X-Geerpc-Servers"), ",")
-	d.servers = make([]string, 0, len(servers))
-	for _, server := range servers {
-		if s := strings.TrimSpace(server); s != "" { // TrimSpace去掉字符串首尾的空格
-			d.servers = append(d.servers, s)
-		}
-	}
+	d.mu.Lock()
+	changed := d.setServersLocked(list.servers)
+	d.weights = list.weights
 	d.lastUpdate = time.Now()
+	d.mu.Unlock()
+	d.setItems(list.items)
+	if changed {
+		d.notify(list.servers)
+	}
 	return nil
 }
 
+type serverList struct {
+	servers []string
+	weights map[string]int
+	index   uint64 // 注册中心服务列表的版本号
+	items   []registry.ServerItem
+}
+
+// Gee注册中心（以及文件）的服务发现共用的注册中心地址、标签过滤条件和实例元数据
+type registryMeta struct {
+	metaMu     sync.RWMutex
+	registries []string // 注册中心地址 有多个时依次尝试
+	current    int      // 上次请求成功的注册中心
+	tags       []string
+	items      map[string]registry.ServerItem // 实例地址 - 元数据
+}
+
+// 从上次请求成功的注册中心开始依次尝试 直到获取到服务列表 extra为nil或在URL上加上额外的参数
+func (m *registryMeta) fetch(ctx context.Context, client *http.Client, extra func(string) string) (*serverList, error) {
+	m.metaMu.RLock()
+	n, start := len(m.registries), m.current
+	m.metaMu.RUnlock()
+	var err error
+	for i := 0; i < n; i++ {
+		j := (start + i) % n
+		u := m.queryURL(m.registries[j])
+		if extra != nil {
+			u = extra(u)
+		}
+		var list *serverList
+		if list, err = fetchServers(ctx, client, u); err == nil {
+			m.metaMu.Lock()
+			m.current = j
+			m.metaMu.Unlock()
+			return list, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
+}
+
+// 只获取带有所有指定标签的实例 需要在获取服务实例之前设置
+func (m *registryMeta) SetTags(tags ...string) {
+	m.metaMu.Lock()
+	defer m.metaMu.Unlock()
+	m.tags = tags
+}
+
+// 在注册中心地址上加上标签过滤条件 并要求以JSON返回
+func (m *registryMeta) queryURL(registryAddr string) string {
+	m.metaMu.RLock()
+	defer m.metaMu.RUnlock()
+	u, err := url.Parse(registryAddr)
+	if err != nil {
+		return registryAddr
+	}
+	q := u.Query()
+	q.Set("format", "json")
+	if len(m.tags) > 0 {
+		q["tag"] = m.tags
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+func (m *registryMeta) setItems(items []registry.ServerItem) {
+	m.metaMu.Lock()
+	defer m.metaMu.Unlock()
+	m.items = make(map[string]registry.ServerItem, len(items))
+	for _, item := range items {
+		m.items[item.Addr] = item
+	}
+}
+
+// 获取实例的元数据
+func (m *registryMeta) Instance(rpcAddr string) (registry.ServerItem, bool) {
+	m.metaMu.RLock()
+	defer m.metaMu.RUnlock()
+	item, ok := m.items[rpcAddr]
+	return item, ok
+}
+
+// 获取所有实例的元数据 按地址排序
+func (m *registryMeta) Instances() []registry.ServerItem {
+	m.metaMu.RLock()
+	defer m.metaMu.RUnlock()
+	items := make([]registry.ServerItem, 0, len(m.items))
+	for _, item := range m.items {
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Addr < items[j].Addr })
+	return items
+}
+
+// 从注册中心获取服务列表 url需要带上format=json参数 client为nil时使用http.DefaultClient
+func fetchServers(ctx context.Context, client *http.Client, url string) (*serverList, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("rpc registry: unexpected status %s", resp.Status)
+	}
+	var result registry.QueryResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return newServerList(&result), nil
+}
+
+func newServerList(result *registry.QueryResult) *serverList {
+	list := &serverList{
+		servers: make([]string, 0, len(result.Servers)),
+		weights: make(map[string]int, len(result.Servers)),
+		index:   result.Index,
+		items:   result.Servers,
+	}
+	for _, item := range result.Servers {
+		list.servers = append(list.servers, item.Addr)
+		list.weights[item.Addr] = item.Weight
+	}
+	return list
+}
+
 // 获取服务实例之前需要先调用Refresh确保实例没过期
 func (d *GeeRegistryDiscovery) Get(mode SelectMode) (string, error) {
 	if err := d.Refresh(); err != nil {
@@ -66,6 +263,20 @@ func (d *GeeRegistryDiscovery) Get(mode SelectMode) (string, error) {
 	return d.MultiServerDiscovery.Get(mode)
 }
 
+func (d *GeeRegistryDiscovery) GetByKey(key string) (string, error) {
+	if err := d.Refresh(); err != nil {
+		return "", err
+	}
+	return d.MultiServerDiscovery.GetByKey(key)
+}
+
+func (d *GeeRegistryDiscovery) GetByStats(mode SelectMode, stats LoadStats) (string, error) {
+	if err := d.Refresh(); err != nil {
+		return "", err
+	}
+	return d.MultiServerDiscovery.GetByStats(mode, stats)
+}
+
 func (d *GeeRegistryDiscovery) GetAll() ([]string, error) {
 	if err := d.Refresh(); err != nil {
 		return nil, err
@@ -0,0 +1,215 @@
+package xclient
+
+import (
+	"context"
+	. "geerpc"
+	"geerpc/registry"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* ****************************************************
+通过注册中心的长轮询接口监听服务列表的变化：后台goroutine带上上次的
+版本号请求注册中心，服务列表变化时立即返回，Get不再需要请求注册中心
+注册中心可以使用HTTP或geerpc协议 后者见NewGeeRegistryRPCDiscovery
+**************************************************** */
+
+type GeeRegistryWatchDiscovery struct {
+	*MultiServerDiscovery
+	registryMeta
+	registry  string        // 去掉token的注册中心地址 用于日志
+	wait      time.Duration // 每次长轮询的最长等待时间
+	client    *http.Client
+	logger    Logger
+	index     uint64 // 当前服务列表在注册中心的版本号 由d.mu保护
+	startOnce sync.Once
+	ready     chan struct{}
+	readyOnce sync.Once
+	ctx       context.Context
+	cancel    context.CancelFunc
+	rpc       *registry.RegistryClient // 不为nil时使用geerpc协议的注册中心
+	query     registry.Query           // 使用geerpc协议时的查询条件
+}
+
+const defaultWatchWait = time.Second * 30
+
+var _ WatchDiscovery = (*GeeRegistryWatchDiscovery)(nil)
+
+// registryAddr可以是以逗号分隔的多个注册中心地址（集群中的多个节点） 请求失败时依次尝试下一个
+// 第一次获取服务实例时开始监听 wait为0时使用默认的30s 需要调用Close停止监听
+func NewGeeRegistryWatchDiscovery(registryAddr string, wait time.Duration) *GeeRegistryWatchDiscovery {
+	if wait <= 0 {
+		wait = defaultWatchWait
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &GeeRegistryWatchDiscovery{
+		MultiServerDiscovery: NewMultiServerDiscovery(make([]string, 0)),
+		registryMeta:         registryMeta{registries: strings.Split(registryAddr, ",")},
+		registry:             registry.RedactToken(registryAddr),
+		wait:                 wait,
+		client:               &http.Client{Timeout: wait + defaultUpdateTimeout}, // 注册中心最多等待wait后返回
+		logger:               DefaultLogger,
+		ready:                make(chan struct{}),
+		ctx:                  ctx,
+		cancel:               cancel,
+	}
+	return d
+}
+
+// 设置日志输出 nil表示丢弃所有日志 需要在获取服务实例之前设置
+func (d *GeeRegistryWatchDiscovery) SetLogger(logger Logger) {
+	if logger == nil {
+		logger = NopLogger
+	}
+	d.logger = logger
+}
+
+// 只监听提供指定服务的实例 registryAddr中可以带上namespace参数指定命名空间
+func NewGeeRegistryWatchDiscoveryForService(registryAddr, service string, wait time.Duration) *GeeRegistryWatchDiscovery {
+	return NewGeeRegistryWatchDiscovery(withQuery(registryAddr, "service", service), wait)
+}
+
+// 通过geerpc协议的注册中心监听服务列表 registryAddr为protocol@addr格式的注册中心地址
+// 可以是以逗号分隔的多个注册中心 连接失败时依次尝试下一个 q为查询条件 标签也可以通过SetTags设置
+// opt为连接注册中心使用的Option 为nil时使用DefaultOption 其HandleTimeout需要为0或大于wait
+func NewGeeRegistryRPCDiscovery(registryAddr string, q registry.Query, wait time.Duration, opt *Option) *GeeRegistryWatchDiscovery {
+	d := NewGeeRegistryWatchDiscovery(registryAddr, wait)
+	d.rpc = registry.NewRegistryClient(registryAddr, opt)
+	d.query = q
+	return d
+}
+
+// 设置访问geerpc协议的注册中心的token 需要在获取服务实例之前设置
+// HTTP协议的注册中心的token放在注册中心地址中 见NewGeeRegistryDiscovery
+func (d *GeeRegistryWatchDiscovery) SetToken(token string) {
+	if d.rpc != nil {
+		d.rpc.SetToken(token)
+	}
+}
+
+// 在注册中心地址上加上长轮询的参数
+func (d *GeeRegistryWatchDiscovery) watchURL(index uint64) func(string) string {
+	return func(u string) string {
+		return withQuery(withQuery(u, "index", strconv.FormatUint(index, 10)), "wait", d.wait.String())
+	}
+}
+
+// 后台监听服务列表 出错时按指数退避重试
+func (d *GeeRegistryWatchDiscovery) watch() {
+	for attempt := 0; ; {
+		d.mu.RLock()
+		index := d.index
+		d.mu.RUnlock()
+		list, err := d.poll(index, true)
+		if d.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			d.logger.Printf("rpc registry: watch %s err: %v", d.registry, err)
+			d.readyOnce.Do(func() { close(d.ready) }) // 第一次请求失败时不再让Get等待
+			select {
+			case <-d.ctx.Done():
+				return
+			case <-time.After(Backoff(time.Millisecond*100, time.Second*10, 2, 0.2, attempt)):
+			}
+			attempt++
+			continue
+		}
+		attempt = 0
+		d.apply(list)
+	}
+}
+
+// 从注册中心获取服务列表 watch为true时为长轮询
+func (d *GeeRegistryWatchDiscovery) poll(index uint64, watch bool) (*serverList, error) {
+	if d.rpc == nil {
+		if !watch {
+			return d.fetch(d.ctx, nil, nil)
+		}
+		return d.fetch(d.ctx, d.client, d.watchURL(index))
+	}
+	q := d.query
+	d.metaMu.RLock()
+	if len(d.tags) > 0 {
+		q.Tags = d.tags
+	}
+	d.metaMu.RUnlock()
+	ctx, cancel := context.WithTimeout(d.ctx, d.wait+defaultUpdateTimeout) // 注册中心最多等待wait后返回
+	defer cancel()
+	var result *registry.QueryResult
+	var err error
+	if watch {
+		result, err = d.rpc.Watch(ctx, q, index, d.wait)
+	} else {
+		result, err = d.rpc.List(ctx, q)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newServerList(result), nil
+}
+
+func (d *GeeRegistryWatchDiscovery) apply(list *serverList) {
+	d.mu.Lock()
+	changed := d.setServersLocked(list.servers)
+	d.weights = list.weights
+	d.index = list.index
+	d.mu.Unlock()
+	d.setItems(list.items)
+	if changed {
+		d.logger.Printf("rpc registry: servers changed to %v (index %d)", list.servers, list.index)
+		d.notify(list.servers)
+	}
+	d.readyOnce.Do(func() { close(d.ready) })
+}
+
+// 立即从注册中心获取一次服务列表 一般不需要调用
+func (d *GeeRegistryWatchDiscovery) Refresh() error {
+	list, err := d.poll(0, false)
+	if err != nil {
+		return err
+	}
+	d.apply(list)
+	return nil
+}
+
+// 开始监听并等待第一次从注册中心获取服务列表
+func (d *GeeRegistryWatchDiscovery) waitReady() {
+	d.startOnce.Do(func() { go d.watch() })
+	select {
+	case <-d.ready:
+	case <-d.ctx.Done():
+	}
+}
+
+func (d *GeeRegistryWatchDiscovery) Get(mode SelectMode) (string, error) {
+	d.waitReady()
+	return d.MultiServerDiscovery.Get(mode)
+}
+
+func (d *GeeRegistryWatchDiscovery) GetByKey(key string) (string, error) {
+	d.waitReady()
+	return d.MultiServerDiscovery.GetByKey(key)
+}
+
+func (d *GeeRegistryWatchDiscovery) GetByStats(mode SelectMode, stats LoadStats) (string, error) {
+	d.waitReady()
+	return d.MultiServerDiscovery.GetByStats(mode, stats)
+}
+
+func (d *GeeRegistryWatchDiscovery) GetAll() ([]string, error) {
+	d.waitReady()
+	return d.MultiServerDiscovery.GetAll()
+}
+
+// 停止监听
+func (d *GeeRegistryWatchDiscovery) Close() error {
+	d.cancel()
+	if d.rpc != nil {
+		return d.rpc.Close()
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package xclient
+
+import (
+	"context"
+	"reflect"
+	"time"
+)
+
+type FailMode int // 调用失败时的处理方式
+
+const (
+	FailDefault FailMode = iota // 未设置 设置了RetryPolicy时与Failover相同 否则只调用一次
+	Failover                    // 换一个实例重试 重试次数等由RetryPolicy决定 未设置时使用DefaultFailoverPolicy
+	Failfast                    // 立即返回错误 即使设置了RetryPolicy也不重试
+	Failtry                     // 在同一个实例上重试 重试次数等由RetryPolicy决定 未设置时使用DefaultFailtryPolicy
+	Failbackup                  // 幂等的调用在BackupLatency内没有返回时 向另一个实例再发送一次 使用先成功的结果
+)
+
+// Failover模式未设置RetryPolicy时使用 立即换其他实例重试
+// 与其他RetryPolicy一样 非幂等的方法只在请求确定没有发送出去时重试
+var DefaultFailoverPolicy = &RetryPolicy{
+	MaxAttempts: 3,
+	RetryOn:     AllErrors,
+}
+
+// Failtry模式未设置RetryPolicy时使用 同一个实例需要时间恢复 因此按指数退避等待
+var DefaultFailtryPolicy = &RetryPolicy{
+	MaxAttempts:    3,
+	InitialBackoff: time.Millisecond * 50,
+	MaxBackoff:     time.Second,
+	Multiplier:     2,
+	Jitter:         0.2,
+	RetryOn:        AllErrors,
+}
+
+const defaultBackupLatency = time.Millisecond * 10
+
+func (xc *XClient) SetFailMode(mode FailMode) {
+	xc.failMode = mode
+}
+
+// 设置Failbackup模式下发送备份请求的等待时间 一般取该方法调用耗时的P90~P99
+func (xc *XClient) SetBackupLatency(d time.Duration) {
+	xc.backupLatency = d
+}
+
+type backupResult struct {
+	reply interface{}
+	sent  bool
+	err   error
+}
+
+// 设置Failbackup模式下可以发送备份请求的幂等方法 "Service.Method"
+func (xc *XClient) SetBackupMethods(methods ...string) {
+	backup := make(map[string]bool, len(methods))
+	for _, m := range methods {
+		backup[m] = true
+	}
+	xc.backupMethods = backup
+}
+
+// 先向一个实例发送请求 超过backupLatency未返回时再向另一个实例发送 返回先成功的结果
+// 备份请求会让服务端重复处理 因此只对幂等的方法发送 非幂等的方法只在第一个请求确定没有发送出去时换一个实例
+func (xc *XClient) callWithBackup(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	ctx, cancel := context.WithCancel(ctx) // 得到结果后取消另一个请求
+	defer cancel()
+	tried := make(map[string]bool)
+	results := make(chan backupResult, 2)
+	sent := 0 // 最多发送两次请求
+	send := func() error {
+		rpcAddr, err := xc.pick(ctx, tried)
+		if err != nil {
+			return err
+		}
+		tried[rpcAddr] = true
+		sent++
+		go func() {
+			// 两个请求同时进行 每个请求使用各自的reply 避免并发写入
+			var clonedReply interface{}
+			if reply != nil {
+				clonedReply = reflect.New(reflect.ValueOf(reply).Elem().Type()).Interface()
+			}
+			sent, err := xc.tryCall(rpcAddr, ctx, serviceMethod, args, clonedReply)
+			results <- backupResult{reply: clonedReply, sent: sent, err: err}
+		}()
+		return nil
+	}
+	if err := send(); err != nil {
+		return err
+	}
+	pending := 1
+	idempotent := xc.backupMethods[serviceMethod]
+	timer := time.NewTimer(xc.backupLatency)
+	defer timer.Stop()
+	var firstErr error
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			if idempotent && sent == 1 && send() == nil {
+				pending++
+			}
+		case result := <-results:
+			pending--
+			if result.err == nil {
+				if reply != nil {
+					reflect.ValueOf(reply).Elem().Set(reflect.ValueOf(result.reply).Elem())
+				}
+				return nil
+			}
+			if firstErr == nil {
+				firstErr = result.err
+			}
+			if sent == 1 && (idempotent || !result.sent) && send() == nil { // 第一个请求在发送备份请求前就失败了 立即发送备份请求
+				pending++
+			}
+		}
+	}
+	return firstErr
+}
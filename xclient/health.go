@@ -0,0 +1,294 @@
+package xclient
+
+import (
+	"context"
+	. "geerpc"
+	"geerpc/registry"
+	"reflect"
+	"sync"
+	"time"
+)
+
+/* ****************************************************
+HealthCheckDiscovery包装另一个Discovery，只返回健康的实例：
+主动探测  每隔Interval探测所有实例 探测失败的实例在下次探测成功前被摘除
+被动摘除  XClient调用某个实例连续出现ConsecutiveErrors次连接错误时摘除该实例
+         摘除时间从BaseEjection开始按次数指数增长 不超过MaxEjection
+健康实例的比例低于PanicThreshold时认为是探测本身出了问题 忽略健康状态返回所有实例
+**************************************************** */
+
+type HealthOption struct {
+	Interval          time.Duration  // 主动探测的间隔 0表示不主动探测
+	Timeout           time.Duration  // 每次探测的超时时间 默认1s
+	Probe             registry.Probe // 探测方法 默认为registry.DialProbe(nil) 只检查能否建立连接并完成Option协商
+	ConsecutiveErrors int            // 连续连接错误达到该次数时摘除 0表示不被动摘除
+	BaseEjection      time.Duration  // 第一次被摘除的时间 默认30s
+	MaxEjection       time.Duration  // 被摘除时间的上限 默认5min
+	PanicThreshold    float64        // 健康实例比例低于该值时返回所有实例 取值[0,1] 0表示不使用
+	Logger            Logger         // 为nil时使用DefaultLogger
+}
+
+// XClient调用结束后把结果反馈给实现了该接口的Discovery 用于被动摘除实例
+type FeedbackDiscovery interface {
+	Discovery
+	Report(rpcAddr string, err error)
+}
+
+type instanceHealth struct {
+	probeFailed  bool      // 最近一次主动探测失败
+	failures     int       // 连续连接错误次数
+	ejections    int       // 连续被摘除的次数 决定下次摘除的时间
+	ejectedUntil time.Time // 被动摘除的截止时间
+}
+
+func (h *instanceHealth) healthy(now time.Time) bool {
+	return !h.probeFailed && !now.Before(h.ejectedUntil)
+}
+
+type HealthCheckDiscovery struct {
+	// 只包含健康的实例 用于按负载均衡策略选择
+	// OnChange通知的是d中的所有实例 被摘除的实例恢复后还会继续使用 不应关闭它的连接池
+	*MultiServerDiscovery
+	d          Discovery
+	opt        HealthOption
+	stateMu    sync.Mutex // 保护health、all
+	health     map[string]*instanceHealth
+	all        []string       // 上次同步时d中的所有实例
+	syncMu     sync.Mutex     // 串行执行sync 保护healthy、srcWeights
+	healthy    []string       // 上次同步时MultiServerDiscovery中的实例
+	srcWeights map[string]int // 上次同步时d中实例的权重
+	logger     Logger
+	closed     chan struct{}
+	closeOnce  sync.Once
+}
+
+var (
+	_ KeyDiscovery      = (*HealthCheckDiscovery)(nil)
+	_ StatsDiscovery    = (*HealthCheckDiscovery)(nil)
+	_ FeedbackDiscovery = (*HealthCheckDiscovery)(nil)
+)
+
+// 创建包装d的HealthCheckDiscovery opt为nil时只使用默认值 不主动探测也不被动摘除
+func NewHealthCheckDiscovery(d Discovery, opt *HealthOption) *HealthCheckDiscovery {
+	var o HealthOption
+	if opt != nil {
+		o = *opt
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = time.Second
+	}
+	if o.Probe == nil {
+		o.Probe = registry.DialProbe(nil)
+	}
+	if o.BaseEjection <= 0 {
+		o.BaseEjection = time.Second * 30
+	}
+	if o.MaxEjection <= 0 {
+		o.MaxEjection = time.Minute * 5
+	}
+	if o.Logger == nil {
+		o.Logger = DefaultLogger
+	}
+	hd := &HealthCheckDiscovery{
+		MultiServerDiscovery: NewMultiServerDiscovery(nil),
+		d:                    d,
+		opt:                  o,
+		health:               make(map[string]*instanceHealth),
+		logger:               o.Logger,
+		closed:               make(chan struct{}),
+	}
+	if o.Interval > 0 {
+		go hd.probeLoop()
+	}
+	return hd
+}
+
+// 停止主动探测
+func (hd *HealthCheckDiscovery) Close() error {
+	hd.closeOnce.Do(func() { close(hd.closed) })
+	return nil
+}
+
+// 需要持有hd.stateMu
+func (hd *HealthCheckDiscovery) stateLocked(rpcAddr string) *instanceHealth {
+	h, ok := hd.health[rpcAddr]
+	if !ok {
+		h = &instanceHealth{}
+		hd.health[rpcAddr] = h
+	}
+	return h
+}
+
+// 从d获取所有实例 把健康的实例更新到MultiServerDiscovery 实例列表没有变化时不更新 以免重置轮询等状态
+// d中的实例列表变化时通知订阅者 通知时不持有锁 避免回调中访问Discovery时死锁
+func (hd *HealthCheckDiscovery) sync() error {
+	all, err := hd.d.GetAll()
+	if err != nil {
+		return err
+	}
+	hd.syncMu.Lock()
+	hd.stateMu.Lock()
+	now := time.Now()
+	present := make(map[string]bool, len(all))
+	healthy := make([]string, 0, len(all))
+	for _, s := range all {
+		present[s] = true
+		if h, ok := hd.health[s]; !ok || h.healthy(now) {
+			healthy = append(healthy, s)
+		}
+	}
+	for s := range hd.health { // 已经下线的实例
+		if !present[s] {
+			delete(hd.health, s)
+		}
+	}
+	if len(all) > 0 && float64(len(healthy)) < hd.opt.PanicThreshold*float64(len(all)) {
+		healthy = all
+	}
+	changed := !equalStrings(all, hd.all)
+	hd.all = all
+	hd.stateMu.Unlock()
+
+	if !equalStrings(healthy, hd.healthy) {
+		hd.healthy = healthy
+		hd.MultiServerDiscovery.setServers(healthy)
+	}
+	if wd, ok := hd.d.(interface{ Weights() map[string]int }); ok {
+		if weights := wd.Weights(); !reflect.DeepEqual(weights, hd.srcWeights) {
+			hd.srcWeights = weights
+			_ = hd.MultiServerDiscovery.UpdateWeights(weights)
+		}
+	}
+	hd.syncMu.Unlock()
+	if changed {
+		hd.MultiServerDiscovery.notify(all)
+	}
+	return nil
+}
+
+func (hd *HealthCheckDiscovery) Refresh() error {
+	if err := hd.d.Refresh(); err != nil {
+		return err
+	}
+	return hd.sync()
+}
+
+func (hd *HealthCheckDiscovery) Update(servers []string) error {
+	if err := hd.d.Update(servers); err != nil {
+		return err
+	}
+	return hd.sync()
+}
+
+func (hd *HealthCheckDiscovery) Get(mode SelectMode) (string, error) {
+	if err := hd.sync(); err != nil {
+		return "", err
+	}
+	return hd.MultiServerDiscovery.Get(mode)
+}
+
+func (hd *HealthCheckDiscovery) GetByKey(key string) (string, error) {
+	if err := hd.sync(); err != nil {
+		return "", err
+	}
+	return hd.MultiServerDiscovery.GetByKey(key)
+}
+
+func (hd *HealthCheckDiscovery) GetByStats(mode SelectMode, stats LoadStats) (string, error) {
+	if err := hd.sync(); err != nil {
+		return "", err
+	}
+	return hd.MultiServerDiscovery.GetByStats(mode, stats)
+}
+
+// 获取所有健康的实例
+func (hd *HealthCheckDiscovery) GetAll() ([]string, error) {
+	if err := hd.sync(); err != nil {
+		return nil, err
+	}
+	return hd.MultiServerDiscovery.GetAll()
+}
+
+// 连接错误计入连续错误次数 达到ConsecutiveErrors时摘除该实例 其他结果清零连续错误次数
+func (hd *HealthCheckDiscovery) Report(rpcAddr string, err error) {
+	if hd.opt.ConsecutiveErrors <= 0 {
+		return
+	}
+	hd.stateMu.Lock()
+	defer hd.stateMu.Unlock()
+	h := hd.stateLocked(rpcAddr)
+	if classifyError(err)&ConnectionError == 0 {
+		h.failures = 0
+		if err == nil {
+			h.ejections = 0
+		}
+		return
+	}
+	h.failures++
+	if h.failures < hd.opt.ConsecutiveErrors {
+		return
+	}
+	d := Backoff(hd.opt.BaseEjection, hd.opt.MaxEjection, 2, 0, h.ejections)
+	h.ejectedUntil = time.Now().Add(d)
+	h.ejections++
+	h.failures = 0
+	hd.logger.Printf("rpc discovery: eject %s for %v after %d consecutive connection errors", rpcAddr, d, hd.opt.ConsecutiveErrors)
+}
+
+// 各个实例当前是否健康 包括被摘除的实例
+func (hd *HealthCheckDiscovery) HealthStates() map[string]bool {
+	hd.stateMu.Lock()
+	defer hd.stateMu.Unlock()
+	now := time.Now()
+	states := make(map[string]bool, len(hd.all))
+	for _, s := range hd.all {
+		h, ok := hd.health[s]
+		states[s] = !ok || h.healthy(now)
+	}
+	return states
+}
+
+func (hd *HealthCheckDiscovery) probeLoop() {
+	t := time.NewTicker(hd.opt.Interval)
+	defer t.Stop()
+	for {
+		hd.probeAll()
+		select {
+		case <-hd.closed:
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// 并发探测所有实例
+func (hd *HealthCheckDiscovery) probeAll() {
+	servers, err := hd.d.GetAll()
+	if err != nil {
+		hd.logger.Printf("rpc discovery: get servers for health check err: %v", err)
+		return
+	}
+	var wg sync.WaitGroup
+	for _, s := range servers {
+		wg.Add(1)
+		go func(rpcAddr string) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), hd.opt.Timeout)
+			defer cancel()
+			err := hd.opt.Probe(ctx, rpcAddr)
+			hd.stateMu.Lock()
+			defer hd.stateMu.Unlock()
+			h := hd.stateLocked(rpcAddr)
+			if failed := err != nil; failed != h.probeFailed {
+				h.probeFailed = failed
+				if failed {
+					hd.logger.Printf("rpc discovery: health check of %s failed: %v", rpcAddr, err)
+				} else {
+					hd.logger.Printf("rpc discovery: %s is healthy again", rpcAddr)
+				}
+			}
+		}(s)
+	}
+	wg.Wait()
+	_ = hd.sync()
+}
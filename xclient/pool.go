@@ -0,0 +1,204 @@
+package xclient
+
+import (
+	. "geerpc"
+	"sync"
+	"time"
+)
+
+/* ****************************************************
+每个实例地址一个连接池：选择负载最小（等待响应的调用最少）的连接，
+所有连接都繁忙且未达到上限时新建连接
+**************************************************** */
+
+type PoolOption struct {
+	MinConns    int           // 每个地址至少保持的连接数 空闲回收时保留
+	MaxConns    int           // 每个地址最多的连接数 默认1
+	IdleTimeout time.Duration // 空闲超过该时间的连接被关闭 0表示不回收
+	MaxLifetime time.Duration // 连接的最长存活时间 到期后不再分配新调用 处理完已有调用后关闭 0表示不限制
+}
+
+var DefaultPoolOption = &PoolOption{MaxConns: 1} // 与之前每个地址复用一个客户端的行为一致
+
+type pooledClient struct {
+	*Client
+	created  time.Time
+	lastUsed time.Time
+	inUse    int  // 已经从连接池取出还未归还的次数 由connPool.mu保护
+	retired  bool // 不再分配新调用 归还后没有调用时关闭
+}
+
+type connPool struct {
+	rpcAddr  string
+	opt      *Option
+	po       func() *PoolOption // 每次使用时读取XClient当前的PoolOption 不能在持有mu时调用
+	mu       sync.Mutex
+	conns    []*pooledClient
+	draining []*pooledClient // 已经退役 等待已有调用完成后关闭
+	dialing  int             // 正在建立的连接数 建立连接时不持有mu
+	drained  bool            // 实例已经下线或XClient已经关闭 不再分配连接
+}
+
+func newConnPool(rpcAddr string, opt *Option, po func() *PoolOption) *connPool {
+	return &connPool{rpcAddr: rpcAddr, opt: opt, po: po}
+}
+
+func expired(po *PoolOption, pc *pooledClient, now time.Time) bool {
+	return po.MaxLifetime > 0 && now.Sub(pc.created) >= po.MaxLifetime
+}
+
+// 连接不再分配新调用 没有在使用时立即关闭 需要持有p.mu
+func (p *connPool) retireLocked(pc *pooledClient) {
+	pc.retired = true
+	if pc.inUse == 0 {
+		_ = pc.Close()
+		return
+	}
+	p.draining = append(p.draining, pc)
+}
+
+// 去掉不可用和到期的连接 需要持有p.mu
+func (p *connPool) cleanLocked(po *PoolOption, now time.Time) {
+	conns := p.conns[:0]
+	for _, pc := range p.conns {
+		switch {
+		case !pc.IsAvailable():
+			_ = pc.Close()
+		case expired(po, pc, now):
+			p.retireLocked(pc)
+		default:
+			conns = append(conns, pc)
+		}
+	}
+	p.conns = conns
+}
+
+// 负载最小的连接 需要持有p.mu
+func (p *connPool) leastLocked() *pooledClient {
+	var least *pooledClient
+	for _, pc := range p.conns {
+		if least == nil || pc.inUse < least.inUse {
+			least = pc
+		}
+	}
+	return least
+}
+
+// 取出一个连接 调用结束后需要通过put归还
+// 新建连接前先占用一个名额 建立连接时释放锁 避免阻塞同一地址的其他调用
+func (p *connPool) get() (*pooledClient, error) {
+	po := p.po()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for {
+		if p.drained {
+			return nil, ErrShutdown
+		}
+		now := time.Now()
+		p.cleanLocked(po, now)
+		least := p.leastLocked()
+		total := len(p.conns) + p.dialing
+		fill := total < po.MinConns // 补足最少连接数 建立后重新选择
+		if !fill && least != nil && (least.inUse == 0 || total >= po.MaxConns) {
+			least.lastUsed = now
+			least.inUse++
+			return least, nil
+		}
+		p.dialing++
+		p.mu.Unlock()
+		client, err := XDial(p.rpcAddr, p.opt)
+		p.mu.Lock()
+		p.dialing--
+		if err != nil {
+			// 新建连接失败时 仍然可以使用已有的连接
+			if least = p.leastLocked(); fill || least == nil || p.drained {
+				return nil, err
+			}
+			least.lastUsed = time.Now()
+			least.inUse++
+			return least, nil
+		}
+		now = time.Now()
+		pc := &pooledClient{Client: client, created: now, lastUsed: now}
+		if p.drained {
+			_ = pc.Close()
+			return nil, ErrShutdown
+		}
+		if fill {
+			p.conns = append(p.conns, pc)
+			continue
+		}
+		pc.inUse++
+		if len(p.conns) >= po.MaxConns {
+			// 并发新建的连接超过了上限 只用于这次调用
+			p.retireLocked(pc)
+			return pc, nil
+		}
+		p.conns = append(p.conns, pc)
+		return pc, nil
+	}
+}
+
+// 归还连接 已经退役的连接在没有调用时关闭
+func (p *connPool) put(pc *pooledClient) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pc.inUse--
+	pc.lastUsed = time.Now()
+	if !pc.retired || pc.inUse > 0 {
+		return
+	}
+	_ = pc.Close()
+	for i, d := range p.draining {
+		if d == pc {
+			p.draining = append(p.draining[:i], p.draining[i+1:]...)
+			break
+		}
+	}
+}
+
+// 实例下线时关闭连接池 空闲的连接立即关闭 其余的连接在已有调用完成后关闭
+func (p *connPool) drain() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.drained = true
+	for _, pc := range p.conns {
+		p.retireLocked(pc)
+	}
+	p.conns = nil
+}
+
+// 回收空闲和到期的连接 由XClient定期调用
+func (p *connPool) reap() {
+	po := p.po()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	p.cleanLocked(po, now)
+	if po.IdleTimeout > 0 {
+		conns := p.conns[:0]
+		for i, pc := range p.conns {
+			idle := pc.inUse == 0 && now.Sub(pc.lastUsed) >= po.IdleTimeout
+			if idle && len(p.conns)-i+len(conns) > po.MinConns {
+				_ = pc.Close()
+				continue
+			}
+			conns = append(conns, pc)
+		}
+		p.conns = conns
+	}
+}
+
+// XClient关闭时立即关闭所有连接 正在建立的连接在建立后关闭
+func (p *connPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.drained = true
+	for _, pc := range p.conns {
+		_ = pc.Close()
+	}
+	for _, pc := range p.draining {
+		_ = pc.Close()
+	}
+	p.conns, p.draining = nil, nil
+}
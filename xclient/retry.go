@@ -0,0 +1,168 @@
+package xclient
+
+import (
+	"context"
+	. "geerpc"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+)
+
+/* ****************************************************
+XClient.Call的重试策略：失败后按指数退避等待，Failover模式下每次重试
+从Discovery重新选择一个未尝试过的实例，Failtry模式下重试同一个实例，
+整体耗时受ctx的deadline限制
+**************************************************** */
+
+type ErrorClass int // 可重试的错误类别 按位组合
+
+const (
+	ConnectionError ErrorClass = 1 << iota // 建立连接失败或连接断开
+	TimeoutError                           // 连接超时或服务端处理超时
+	OverloadError                          // 服务端过载 错误信息中包含overload
+	AllErrors       = ConnectionError | TimeoutError | OverloadError
+)
+
+type RetryPolicy struct {
+	MaxAttempts    int           // 包括第一次调用在内的最大尝试次数
+	InitialBackoff time.Duration // 第一次重试前的等待时间
+	MaxBackoff     time.Duration // 等待时间的上限
+	Multiplier     float64       // 每次重试等待时间的倍数
+	Jitter         float64       // 随机抖动比例 取值[0,1]
+	RetryOn        ErrorClass    // 哪些类别的错误可以重试
+	// 幂等的服务方法 "Service.Method" 只有幂等方法在请求可能已经被服务端处理后才会重试
+	// 非幂等方法仅在请求确定没有发送出去（例如建立连接失败）时重试
+	Idempotent map[string]bool
+}
+
+var DefaultRetryPolicy = &RetryPolicy{
+	MaxAttempts:    3,
+	InitialBackoff: time.Millisecond * 50,
+	MaxBackoff:     time.Second,
+	Multiplier:     2,
+	Jitter:         0.2,
+	RetryOn:        AllErrors,
+}
+
+// 设置XClient.Call的重试策略 在FailDefault、Failover和Failtry模式下生效
+// nil表示FailDefault模式下不重试 Failover和Failtry模式下使用各自的默认策略
+func (xc *XClient) SetRetryPolicy(policy *RetryPolicy) {
+	xc.retry = policy
+}
+
+// 未设置RetryPolicy时使用def
+func (xc *XClient) retryPolicy(def *RetryPolicy) *RetryPolicy {
+	if xc.retry == nil {
+		return def
+	}
+	return xc.retry
+}
+
+// 对错误进行分类 返回0表示不属于任何可重试的类别
+func classifyError(err error) ErrorClass {
+	if err == nil {
+		return 0
+	}
+	if err == ErrShutdown || err == ErrCircuitOpen || err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ConnectionError
+	}
+	if ne, ok := err.(net.Error); ok {
+		if ne.Timeout() {
+			return TimeoutError
+		}
+		return ConnectionError
+	}
+	// 服务端返回的错误只有错误信息 只能根据内容判断
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "call failed"): // 调用方的ctx超时或被取消 不应重试
+		return 0
+	case strings.Contains(msg, "timeout"):
+		return TimeoutError
+	case strings.Contains(msg, "overload"):
+		return OverloadError
+	case strings.Contains(msg, "connection refused"), strings.Contains(msg, "connection reset"),
+		strings.Contains(msg, "broken pipe"), strings.Contains(msg, "connection is shut down"):
+		return ConnectionError
+	}
+	return 0
+}
+
+func (p *RetryPolicy) shouldRetry(serviceMethod string, err error, sent bool) bool {
+	if p.RetryOn&classifyError(err) == 0 {
+		return false
+	}
+	return !sent || p.Idempotent[serviceMethod]
+}
+
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	return Backoff(p.InitialBackoff, p.MaxBackoff, p.Multiplier, p.Jitter, attempt)
+}
+
+// 按负载均衡策略选择一个还没有尝试过且未被熔断的实例
+// 选中的实例不满足条件时从其余实例中随机选择 所有实例都尝试过时允许重复
+func (xc *XClient) pick(ctx context.Context, tried map[string]bool) (string, error) {
+	rpcAddr, err := xc.get(ctx)
+	if err != nil {
+		return "", err
+	}
+	if !tried[rpcAddr] && xc.available(rpcAddr) {
+		return rpcAddr, nil
+	}
+	servers, err := xc.d.GetAll()
+	if err != nil {
+		return "", err
+	}
+	var untried, available []string
+	for _, s := range servers {
+		if !xc.available(s) {
+			continue
+		}
+		available = append(available, s)
+		if !tried[s] {
+			untried = append(untried, s)
+		}
+	}
+	switch {
+	case len(untried) > 0:
+		return untried[rand.Intn(len(untried))], nil
+	case len(available) > 0:
+		return available[rand.Intn(len(available))], nil
+	}
+	return "", ErrCircuitOpen
+}
+
+// sameServer为true时所有尝试都使用第一次选择的实例
+func (xc *XClient) callWithRetry(ctx context.Context, policy *RetryPolicy, sameServer bool, serviceMethod string, args, reply interface{}) error {
+	tried := make(map[string]bool)
+	var rpcAddr string
+	var err error
+	for attempt := 0; attempt < policy.MaxAttempts || attempt == 0; attempt++ {
+		if attempt > 0 {
+			d := policy.backoff(attempt - 1)
+			if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < d {
+				return err // 等待之后已经超过deadline 直接返回最后一次的错误
+			}
+			select {
+			case <-ctx.Done():
+				return err
+			case <-time.After(d):
+			}
+		}
+		if !sameServer || rpcAddr == "" {
+			if rpcAddr, err = xc.pick(ctx, tried); err != nil {
+				return err
+			}
+			tried[rpcAddr] = true
+		}
+		var sent bool
+		sent, err = xc.tryCall(rpcAddr, ctx, serviceMethod, args, reply)
+		if err == nil || !policy.shouldRetry(serviceMethod, err, sent) {
+			return err
+		}
+		xc.logger().Printf("rpc xclient: call %s on %s failed (attempt %d): %v", serviceMethod, rpcAddr, attempt+1, err)
+	}
+	return err
+}
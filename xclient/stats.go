@@ -0,0 +1,185 @@
+package xclient
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+/* ****************************************************
+客户端统计的每个实例的负载：正在进行的请求数和延迟的EWMA，
+用于LeastActiveSelect和P2CSelect。延迟使用peak EWMA：
+新样本大于当前值时直接取新样本，否则按距上次更新的时间衰减，
+这样实例变慢时能很快被发现，变快时逐渐恢复
+**************************************************** */
+
+// 实例的负载信息 由XClient提供给Discovery
+type LoadStats interface {
+	Active(rpcAddr string) int            // 正在进行的请求数
+	Latency(rpcAddr string) time.Duration // 延迟的EWMA 没有样本时为0
+}
+
+// 支持根据客户端负载信息选择实例的Discovery 用于LeastActiveSelect和P2CSelect
+type StatsDiscovery interface {
+	Discovery
+	GetByStats(mode SelectMode, stats LoadStats) (string, error)
+}
+
+const (
+	defaultDecay   = time.Second * 10 // EWMA的衰减时间常数
+	failurePenalty = time.Second      // 连接、超时、过载错误按该延迟计入 避免失败快的实例吸引更多请求
+)
+
+type addrStats struct {
+	active  int
+	latency float64 // 纳秒
+	updated time.Time
+}
+
+type clientStats struct {
+	mu    sync.Mutex
+	decay time.Duration
+	addrs map[string]*addrStats
+}
+
+func newClientStats() *clientStats {
+	return &clientStats{decay: defaultDecay, addrs: make(map[string]*addrStats)}
+}
+
+// 需要持有s.mu
+func (s *clientStats) getLocked(rpcAddr string) *addrStats {
+	a, ok := s.addrs[rpcAddr]
+	if !ok {
+		a = &addrStats{}
+		s.addrs[rpcAddr] = a
+	}
+	return a
+}
+
+// 请求开始时调用 返回请求结束时调用的函数
+func (s *clientStats) start(rpcAddr string) func(failed bool) {
+	s.mu.Lock()
+	s.getLocked(rpcAddr).active++
+	s.mu.Unlock()
+	start := time.Now()
+	return func(failed bool) {
+		now := time.Now()
+		rtt := now.Sub(start)
+		if failed && rtt < failurePenalty {
+			rtt = failurePenalty
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		a := s.getLocked(rpcAddr)
+		a.active--
+		a.observe(float64(rtt), now, s.decay)
+	}
+}
+
+func (a *addrStats) observe(rtt float64, now time.Time, decay time.Duration) {
+	if a.updated.IsZero() || rtt > a.latency {
+		a.latency = rtt
+	} else {
+		w := math.Exp(-float64(now.Sub(a.updated)) / float64(decay))
+		a.latency = a.latency*w + rtt*(1-w)
+	}
+	a.updated = now
+}
+
+func (s *clientStats) Active(rpcAddr string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if a, ok := s.addrs[rpcAddr]; ok {
+		return a.active
+	}
+	return 0
+}
+
+func (s *clientStats) Latency(rpcAddr string) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if a, ok := s.addrs[rpcAddr]; ok {
+		return time.Duration(a.latency)
+	}
+	return 0
+}
+
+// 删除已经下线的实例的统计
+func (s *clientStats) remove(alive map[string]bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for addr, a := range s.addrs {
+		if !alive[addr] && a.active == 0 { // 还有调用在进行时保留 避免调用结束时计数出错
+			delete(s.addrs, addr)
+		}
+	}
+}
+
+// XClient统计的各个实例的负载信息
+func (xc *XClient) Stats() LoadStats {
+	return xc.stats
+}
+
+// 设置延迟EWMA的衰减时间常数 越小越偏重最近的样本
+func (xc *XClient) SetStatsDecay(d time.Duration) {
+	if d <= 0 {
+		d = defaultDecay
+	}
+	xc.stats.mu.Lock()
+	xc.stats.decay = d
+	xc.stats.mu.Unlock()
+}
+
+// 选择正在进行的请求数最少的实例 相同时随机选择 需要持有d.mu
+func (d *MultiServerDiscovery) leastActive(stats LoadStats) string {
+	var best []string
+	min := math.MaxInt32
+	for _, s := range d.servers {
+		active := stats.Active(s)
+		switch {
+		case active < min:
+			min, best = active, append(best[:0], s)
+		case active == min:
+			best = append(best, s)
+		}
+	}
+	return best[d.r.Intn(len(best))]
+}
+
+// 随机选择两个实例 返回延迟EWMA乘以(请求数+1)较小的一个 需要持有d.mu
+func (d *MultiServerDiscovery) p2c(stats LoadStats) string {
+	n := len(d.servers)
+	if n == 1 {
+		return d.servers[0]
+	}
+	i := d.r.Intn(n)
+	j := d.r.Intn(n - 1)
+	if j >= i {
+		j++
+	}
+	a, b := d.servers[i], d.servers[j]
+	if cost(stats, b) < cost(stats, a) {
+		return b
+	}
+	return a
+}
+
+func cost(stats LoadStats, rpcAddr string) float64 {
+	return float64(stats.Latency(rpcAddr)) * float64(stats.Active(rpcAddr)+1)
+}
+
+func (d *MultiServerDiscovery) GetByStats(mode SelectMode, stats LoadStats) (string, error) {
+	if mode != LeastActiveSelect && mode != P2CSelect {
+		return d.Get(mode)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.servers) == 0 {
+		return "", errors.New("rpc discovery: no available servers")
+	}
+	if mode == LeastActiveSelect {
+		return d.leastActive(stats), nil
+	}
+	return d.p2c(stats), nil
+}
@@ -2,92 +2,288 @@ package xclient
 
 import (
 	"context"
+	"errors"
 	. "geerpc"
 	"io"
 	"reflect"
 	"sync"
+	"time"
 )
 
 type XClient struct { // 支持负载均衡的客户端	———— 复用了geerpc.Client的功能
-	d       Discovery
-	mode    SelectMode
-	opt     *Option
-	mu      sync.Mutex
-	clients map[string]*Client // 复用已创建好的连接 实例地址 - 对应的客户端
+	d             Discovery
+	mode          SelectMode
+	opt           *Option
+	po            *PoolOption
+	retry         *RetryPolicy // nil表示不重试
+	failMode      FailMode
+	backupLatency time.Duration   // Failbackup模式下发送备份请求前的等待时间
+	backupMethods map[string]bool // Failbackup模式下可以发送备份请求的幂等方法
+	breakerOpt    *BreakerOption
+	breakers      map[string]*breaker // 实例地址 - 熔断器
+	// ConsistentHashSelect模式下从调用参数计算key
+	hashKeyFunc func(serviceMethod string, args interface{}) string
+	stats       *clientStats // 各个实例正在进行的请求数和延迟
+	mu          sync.Mutex
+	pools       map[string]*connPool // 复用已创建好的连接 实例地址 - 对应的连接池
+	closed      chan struct{}        // 关闭后停止定期回收连接的goroutine
+	closeOnce   sync.Once
+	reapOnce    sync.Once
+	unwatch     func() // 取消订阅Discovery的服务列表变化
 }
 
 func NewXClient(d Discovery, mode SelectMode, opt *Option) *XClient {
-	return &XClient{
-		d:       d,
-		mode:    mode,
-		opt:     opt,
-		clients: make(map[string]*Client),
+	xc := &XClient{
+		d:             d,
+		mode:          mode,
+		opt:           opt,
+		po:            DefaultPoolOption,
+		pools:         make(map[string]*connPool),
+		closed:        make(chan struct{}),
+		backupLatency: defaultBackupLatency,
+		breakers:      make(map[string]*breaker),
+		stats:         newClientStats(),
 	}
+	if wd, ok := d.(WatchDiscovery); ok {
+		xc.unwatch = wd.OnChange(xc.removeStale)
+	}
+	return xc
+}
+
+// 服务列表变化后 关闭已经下线的实例的连接池 并清理对应的熔断器和统计
+func (xc *XClient) removeStale(servers []string) {
+	alive := make(map[string]bool, len(servers))
+	for _, s := range servers {
+		alive[s] = true
+	}
+	xc.mu.Lock()
+	var stale []*connPool
+	for addr, pool := range xc.pools {
+		if !alive[addr] {
+			stale = append(stale, pool)
+			delete(xc.pools, addr)
+			xc.logger().Printf("rpc xclient: %s is removed, close its connections", addr)
+		}
+	}
+	for addr := range xc.breakers {
+		if !alive[addr] {
+			delete(xc.breakers, addr)
+		}
+	}
+	xc.mu.Unlock()
+	xc.stats.remove(alive)
+	for _, pool := range stale {
+		pool.drain()
+	}
+}
+
+// 设置每个地址的连接池 已经创建的连接池在下次取连接和回收时使用新的设置
+func (xc *XClient) SetPoolOption(po *PoolOption) {
+	p := *po
+	if p.MaxConns < 1 {
+		p.MaxConns = 1
+	}
+	if p.MinConns > p.MaxConns {
+		p.MinConns = p.MaxConns
+	}
+	xc.mu.Lock()
+	xc.po = &p
+	xc.mu.Unlock()
+	if reapInterval(&p) > 0 {
+		xc.reapOnce.Do(func() { go xc.reap() })
+	}
+}
+
+// 回收连接的间隔 为0时不需要回收
+func reapInterval(po *PoolOption) time.Duration {
+	interval := po.IdleTimeout
+	if interval == 0 || (po.MaxLifetime > 0 && po.MaxLifetime < interval) {
+		interval = po.MaxLifetime
+	}
+	return interval / 2
+}
+
+const idleReapInterval = time.Second // 当前的PoolOption不需要回收时 检查PoolOption是否变化的间隔
+
+// 定期回收空闲和到期的连接 每次按当前的PoolOption计算间隔
+func (xc *XClient) reap() {
+	for {
+		xc.mu.Lock()
+		interval := reapInterval(xc.po)
+		xc.mu.Unlock()
+		if interval <= 0 {
+			interval = idleReapInterval
+		}
+		select {
+		case <-xc.closed:
+			return
+		case <-time.After(interval):
+		}
+		xc.mu.Lock()
+		pools := make([]*connPool, 0, len(xc.pools))
+		for _, pool := range xc.pools {
+			pools = append(pools, pool)
+		}
+		xc.mu.Unlock()
+		for _, pool := range pools {
+			pool.reap()
+		}
+	}
+}
+
+// 链路追踪沿用Option中的Tracer 与底层geerpc.Client保持一致
+func (xc *XClient) tracer() *Tracer {
+	if xc.opt == nil {
+		return nil
+	}
+	return xc.opt.Tracer
+}
+
+func (xc *XClient) logger() Logger {
+	if xc.opt == nil || xc.opt.Logger == nil {
+		return DefaultLogger
+	}
+	return xc.opt.Logger
 }
 
 func (xc *XClient) Close() error {
+	xc.closeOnce.Do(func() {
+		close(xc.closed)
+		if xc.unwatch != nil {
+			xc.unwatch()
+		}
+	})
 	xc.mu.Lock()
 	defer xc.mu.Unlock()
-	for key, client := range xc.clients {
-		_ = client.Close()
-		delete(xc.clients, key)
+	for key, pool := range xc.pools {
+		pool.close()
+		delete(xc.pools, key)
 	}
 	return nil
 }
 
 var _ io.Closer = (*XClient)(nil)
 
-// 创建客户端
-func (xc *XClient) dial(rpcAddr string) (*Client, error) {
+// 连接池每次使用时读取当前的PoolOption SetPoolOption会替换xc.po而不是修改它
+func (xc *XClient) poolOption() *PoolOption {
 	xc.mu.Lock()
 	defer xc.mu.Unlock()
+	return xc.po
+}
 
-	client, ok := xc.clients[rpcAddr]
-	if ok && !client.IsAvailable() { // 客户端不可用
-		_ = client.Close()
-		delete(xc.clients, rpcAddr)
-		client = nil
-	}
-	if client == nil {
-		var err error
-		client, err = XDial(rpcAddr, xc.opt)
-		if err != nil {
-			return nil, err
-		}
-		xc.clients[rpcAddr] = client
+// 从对应地址的连接池中取出连接 调用结束后需要调用release归还
+func (xc *XClient) dial(rpcAddr string) (client *Client, release func(), err error) {
+	xc.mu.Lock()
+	pool, ok := xc.pools[rpcAddr]
+	if !ok {
+		pool = newConnPool(rpcAddr, xc.opt, xc.poolOption)
+		xc.pools[rpcAddr] = pool
+	}
+	xc.mu.Unlock()
+	pc, err := pool.get()
+	if err != nil {
+		return nil, nil, err
 	}
-	return client, nil
+	return pc.Client, func() { pool.put(pc) }, nil
 }
 
 func (xc *XClient) call(rpcAddr string, ctx context.Context, serviceMethod string, args, reply interface{}) error {
-	client, err := xc.dial(rpcAddr)
+	_, err := xc.tryCall(rpcAddr, ctx, serviceMethod, args, reply)
+	return err
+}
+
+// sent表示请求是否可能已经发送给服务端 用于判断非幂等的调用能否重试
+func (xc *XClient) tryCall(rpcAddr string, ctx context.Context, serviceMethod string, args, reply interface{}) (sent bool, err error) {
+	b := xc.breaker(rpcAddr)
+	var probe bool
+	if b != nil {
+		var ok bool
+		if ok, probe = b.acquire(); !ok {
+			return false, ErrCircuitOpen
+		}
+		defer func() {
+			if state, changed := b.record(classifyError(err) != 0, probe); changed {
+				xc.logger().Printf("rpc xclient: circuit breaker of %s is %s", rpcAddr, state)
+			}
+		}()
+	}
+	done := xc.stats.start(rpcAddr)
+	defer func() {
+		done(classifyError(err) != 0)
+		if fd, ok := xc.d.(FeedbackDiscovery); ok {
+			fd.Report(rpcAddr, err)
+		}
+	}()
+	client, release, err := xc.dial(rpcAddr)
 	if err != nil {
-		return err
+		return false, err
+	}
+	defer release()
+	err = client.Call(ctx, serviceMethod, args, reply)
+	return err != ErrShutdown, err // ErrShutdown说明连接已不可用 请求没有发送
+}
+
+// 按负载均衡策略选择实例 ConsistentHashSelect模式下使用ctx中的key 按负载选择时使用客户端的统计
+func (xc *XClient) get(ctx context.Context) (string, error) {
+	switch xc.mode {
+	case ConsistentHashSelect:
+		kd, ok := xc.d.(KeyDiscovery)
+		if !ok {
+			return "", errors.New("rpc xclient: discovery does not support consistent hash select")
+		}
+		key, ok := hashKeyFromContext(ctx)
+		if !ok {
+			return "", errors.New("rpc xclient: no hash key for consistent hash select")
+		}
+		return kd.GetByKey(key)
+	case LeastActiveSelect, P2CSelect:
+		sd, ok := xc.d.(StatsDiscovery)
+		if !ok {
+			return "", errors.New("rpc xclient: discovery does not support least active and p2c select")
+		}
+		return sd.GetByStats(xc.mode, xc.stats)
 	}
-	return client.Call(ctx, serviceMethod, args, reply)
+	return xc.d.Get(xc.mode)
 }
 
 func (xc *XClient) Call(ctx context.Context, serviceMethod string, args, reply interface{}) error {
-	rpcAddr, err := xc.d.Get(xc.mode)
+	ctx = xc.withHashKey(ctx, serviceMethod, args)
+	switch xc.failMode {
+	case Failbackup:
+		return xc.callWithBackup(ctx, serviceMethod, args, reply)
+	case Failover:
+		return xc.callWithRetry(ctx, xc.retryPolicy(DefaultFailoverPolicy), false, serviceMethod, args, reply)
+	case Failtry:
+		return xc.callWithRetry(ctx, xc.retryPolicy(DefaultFailtryPolicy), true, serviceMethod, args, reply)
+	case FailDefault:
+		if xc.retry != nil {
+			return xc.callWithRetry(ctx, xc.retry, false, serviceMethod, args, reply)
+		}
+	}
+	rpcAddr, err := xc.pick(ctx, nil)
 	if err != nil {
 		return err
 	}
 	return xc.call(rpcAddr, ctx, serviceMethod, args, reply)
 }
 
-// 并发向所有实例调用指定的方法
+// 并发向所有实例调用指定的方法 跳过被熔断的实例 所有实例都被熔断时返回ErrCircuitOpen
 func (xc *XClient) Broadcast(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	ctx, span := xc.tracer().StartSpan(ctx, "Broadcast "+serviceMethod, SpanKindInternal)
 	servers, err := xc.d.GetAll()
 	if err != nil {
+		span.Finish(err)
 		return err
 	}
 
 	var wg sync.WaitGroup
 	var mu sync.Mutex
 	var e error
+	skipped := 0 // 被熔断而没有调用的实例数
 	replyDone := reply == nil
 
 	ctx, cancel := context.WithCancel(ctx) // 借助 context.WithCancel 确保有错误发生时，快速通知其他使用了context的实例
+	defer cancel()
 	for _, rpcAddr := range servers {
 		wg.Add(1)
 		go func(rpcAddr string) {
@@ -96,8 +292,16 @@ func (xc *XClient) Broadcast(ctx context.Context, serviceMethod string, args, re
 			if reply != nil {
 				clonedReply = reflect.New(reflect.ValueOf(reply).Elem().Type()).Interface()
 			}
+			ctx, child := xc.tracer().StartSpan(ctx, rpcAddr, SpanKindInternal) // 每个实例一个子span
+			child.SetAttr("peer.addr", rpcAddr)
 			err := xc.call(rpcAddr, ctx, serviceMethod, args, clonedReply)
+			child.Finish(err)
 			mu.Lock()
+			if err == ErrCircuitOpen { // 熔断的实例不影响其他实例的调用
+				skipped++
+				mu.Unlock()
+				return
+			}
 			if err != nil && e == nil { // 遇到错误则取消其他执行调用
 				e = err
 				cancel()
@@ -110,5 +314,9 @@ func (xc *XClient) Broadcast(ctx context.Context, serviceMethod string, args, re
 		}(rpcAddr)
 	}
 	wg.Wait()
+	if e == nil && len(servers) > 0 && skipped == len(servers) {
+		e = ErrCircuitOpen
+	}
+	span.Finish(e)
 	return e
 }
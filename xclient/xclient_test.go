@@ -0,0 +1,840 @@
+package xclient
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	. "geerpc"
+	"geerpc/registry"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type Foo int
+type Args struct{ Num1, Num2 int }
+
+func (f Foo) Sum(args Args, reply *int) error {
+	*reply = args.Num1 + args.Num2
+	return nil
+}
+
+func (f Foo) Sleep(args Args, reply *int) error {
+	time.Sleep(time.Millisecond * time.Duration(args.Num1))
+	*reply = args.Num1 + args.Num2
+	return nil
+}
+
+func _assert(condition bool, msg string, v ...interface{}) {
+	if !condition {
+		panic(fmt.Sprintf("assertion failed: "+msg, v...))
+	}
+}
+
+// 启动一个注册了Foo服务的服务端 返回tcp@addr格式的地址和监听器
+func startServer(t *testing.T) (string, net.Listener) {
+	var foo Foo
+	server := NewServer()
+	server.SetLogger(nil)
+	_ = server.Register(&foo)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Accept(l)
+	return "tcp@" + l.Addr().String(), l
+}
+
+func TestXClient_Pool(t *testing.T) {
+	addr, l := startServer(t)
+	defer l.Close()
+	xc := NewXClient(NewMultiServerDiscovery([]string{addr}), RandomSelect, nil)
+	xc.SetPoolOption(&PoolOption{MaxConns: 3})
+	defer xc.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var reply int
+			err := xc.Call(context.Background(), "Foo.Sleep", &Args{Num1: 200}, &reply)
+			_assert(err == nil && reply == 200, "failed to call Foo.Sleep: %v", err)
+		}()
+		time.Sleep(time.Millisecond * 10)
+	}
+	wg.Wait()
+	pool := xc.pools[addr]
+	_assert(len(pool.conns) == 3, "expect 3 connections, got %d", len(pool.conns))
+}
+
+func TestXClient_SetPoolOptionAfterCall(t *testing.T) {
+	addr, l := startServer(t)
+	defer l.Close()
+	xc := NewXClient(NewMultiServerDiscovery([]string{addr}), RandomSelect, nil)
+	defer xc.Close()
+	var reply int
+	err := xc.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 3, "failed to call Foo.Sum: %v", err)
+
+	// 已经创建的连接池也使用新的设置
+	xc.SetPoolOption(&PoolOption{MinConns: 2, MaxConns: 2})
+	err = xc.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 3, "failed to call Foo.Sum: %v", err)
+	pool := xc.pools[addr]
+	pool.mu.Lock()
+	n := len(pool.conns)
+	pool.mu.Unlock()
+	_assert(n == 2, "expect 2 connections after SetPoolOption, got %d", n)
+}
+
+func TestConnPool_Drain(t *testing.T) {
+	addr, l := startServer(t)
+	defer l.Close()
+	po := &PoolOption{MaxConns: 1, IdleTimeout: time.Nanosecond}
+	pool := newConnPool(addr, nil, func() *PoolOption { return po })
+	pc, err := pool.get()
+	_assert(err == nil, "failed to get connection: %v", err)
+
+	// 取出但还未发出请求的连接不能被回收或关闭
+	time.Sleep(time.Millisecond)
+	pool.reap()
+	pool.drain()
+	_assert(pc.IsAvailable(), "connection in use should not be closed")
+	var reply int
+	err = pc.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 3, "failed to call on draining connection: %v", err)
+	pool.put(pc)
+	_assert(!pc.IsAvailable(), "connection should be closed after it is returned")
+	_, err = pool.get()
+	_assert(err == ErrShutdown, "expect ErrShutdown from drained pool, got %v", err)
+}
+
+func TestXClient_Retry(t *testing.T) {
+	addr, l := startServer(t)
+	defer l.Close()
+	dead, dl := startServer(t)
+	_ = dl.Close() // 连接该地址会失败
+
+	xc := NewXClient(NewMultiServerDiscovery([]string{dead, addr}), RoundRobinSelect, &Option{Logger: NopLogger})
+	xc.SetRetryPolicy(&RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond, RetryOn: ConnectionError})
+	defer xc.Close()
+	for i := 0; i < 4; i++ {
+		var reply int
+		err := xc.Call(context.Background(), "Foo.Sum", &Args{Num1: i, Num2: 1}, &reply)
+		_assert(err == nil && reply == i+1, "failed to call Foo.Sum with retry: %v", err)
+	}
+}
+
+// 记录被调用次数的服务
+type Counter struct{ n int32 }
+
+func (c *Counter) Slow(args Args, reply *int) error {
+	atomic.AddInt32(&c.n, 1)
+	time.Sleep(time.Millisecond * time.Duration(args.Num1))
+	*reply = args.Num1 + args.Num2
+	return nil
+}
+
+func startCounter(t *testing.T) (string, *Counter, net.Listener) {
+	var c Counter
+	server := NewServer()
+	server.SetLogger(nil)
+	_ = server.Register(&c)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Accept(l)
+	return "tcp@" + l.Addr().String(), &c, l
+}
+
+func TestXClient_Failbackup(t *testing.T) {
+	addr1, c1, l1 := startCounter(t)
+	defer l1.Close()
+	addr2, c2, l2 := startCounter(t)
+	defer l2.Close()
+	xc := NewXClient(NewMultiServerDiscovery([]string{addr1, addr2}), RandomSelect, nil)
+	xc.SetFailMode(Failbackup)
+	xc.SetBackupLatency(time.Millisecond * 50)
+	defer xc.Close()
+
+	// 非幂等的方法不发送备份请求
+	var reply int
+	err := xc.Call(context.Background(), "Counter.Slow", &Args{Num1: 100, Num2: 1}, &reply)
+	_assert(err == nil && reply == 101, "failed to call Counter.Slow: %v", err)
+	time.Sleep(time.Millisecond * 50)
+	n := atomic.LoadInt32(&c1.n) + atomic.LoadInt32(&c2.n)
+	_assert(n == 1, "expect no backup request for non-idempotent call, got %d calls", n)
+
+	xc.SetBackupMethods("Counter.Slow")
+	start := time.Now()
+	err = xc.Call(context.Background(), "Counter.Slow", &Args{Num1: 100, Num2: 1}, &reply)
+	_assert(err == nil && reply == 101, "failed to call Counter.Slow: %v", err)
+	_assert(time.Since(start) < time.Millisecond*150, "backup request should not delay the first reply")
+	time.Sleep(time.Millisecond * 50)
+	n = atomic.LoadInt32(&c1.n) + atomic.LoadInt32(&c2.n)
+	_assert(n == 3, "expect a backup request for idempotent call, got %d calls", n)
+}
+
+func TestXClient_FailMode(t *testing.T) {
+	addr, l := startServer(t)
+	defer l.Close()
+	dead, dl := startServer(t)
+	_ = dl.Close()
+
+	// 未设置FailMode和RetryPolicy时只调用一次
+	xc := NewXClient(NewMultiServerDiscovery([]string{dead, addr}), RoundRobinSelect, &Option{Logger: NopLogger})
+	defer xc.Close()
+	var failed bool
+	for i := 0; i < 2; i++ {
+		var reply int
+		failed = failed || xc.Call(context.Background(), "Foo.Sum", &Args{Num1: i, Num2: 1}, &reply) != nil
+	}
+	_assert(failed, "expect the default fail mode not to retry")
+
+	// 未设置RetryPolicy时Failover模式也会换一个实例重试
+	xc.SetFailMode(Failover)
+	for i := 0; i < 4; i++ {
+		var reply int
+		err := xc.Call(context.Background(), "Foo.Sum", &Args{Num1: i, Num2: 1}, &reply)
+		_assert(err == nil && reply == i+1, "failed to fail over: %v", err)
+	}
+	xc.SetFailMode(Failfast)
+	failed = false
+	for i := 0; i < 2; i++ {
+		var reply int
+		failed = failed || xc.Call(context.Background(), "Foo.Sum", &Args{Num1: i, Num2: 1}, &reply) != nil
+	}
+	_assert(failed, "expect Failfast not to retry")
+
+	// 未设置RetryPolicy时Failtry模式在同一个实例上重试
+	var buf bytes.Buffer
+	xc2 := NewXClient(NewMultiServerDiscovery([]string{dead}), RandomSelect, &Option{Logger: log.New(&buf, "", 0)})
+	defer xc2.Close()
+	xc2.SetFailMode(Failtry)
+	var reply int
+	err := xc2.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 1}, &reply)
+	_assert(err != nil, "expect call to dead server to fail")
+	n := strings.Count(buf.String(), "failed (attempt")
+	_assert(n == DefaultFailtryPolicy.MaxAttempts, "expect %d attempts, got %d", DefaultFailtryPolicy.MaxAttempts, n)
+}
+
+func TestXClient_Breaker(t *testing.T) {
+	addr, l := startServer(t)
+	defer l.Close()
+	dead, dl := startServer(t)
+	_ = dl.Close()
+
+	xc := NewXClient(NewMultiServerDiscovery([]string{dead, addr}), RoundRobinSelect, &Option{Logger: NopLogger})
+	xc.SetBreakerOption(&BreakerOption{ConsecutiveFailures: 1, CoolDown: time.Minute})
+	defer xc.Close()
+	failed := 0
+	for i := 0; i < 6; i++ {
+		var reply int
+		if err := xc.Call(context.Background(), "Foo.Sum", &Args{Num1: i, Num2: 1}, &reply); err != nil {
+			failed++
+		}
+	}
+	_assert(failed == 1, "expect only the first call to the dead server to fail, got %d failures", failed)
+	states := xc.BreakerStates()
+	_assert(states[dead] == BreakerOpen && states[addr] == BreakerClosed, "unexpected breaker states %v", states)
+
+	// 广播时跳过被熔断的实例 Quorum中计为失败
+	var reply int
+	err := xc.Broadcast(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 3, "expect broadcast to skip the open breaker: %v", err)
+	results, err := xc.BroadcastAll(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && results[dead].Error == ErrCircuitOpen && results[addr].Error == nil, "expect open breaker to count as a failure: %v", results)
+}
+
+func TestMultiServerDiscovery_Weighted(t *testing.T) {
+	d := NewMultiServerDiscovery([]string{"a", "b", "c"})
+	_ = d.UpdateWeights(map[string]int{"a": 5, "b": 1})
+	var got []string
+	for i := 0; i < 7; i++ {
+		s, _ := d.Get(WeightedRoundRobinSelect)
+		got = append(got, s)
+	}
+	// 与nginx的平滑加权轮询结果一致
+	_assert(fmt.Sprint(got) == "[a a b a c a a]", "unexpected smooth weighted round robin order %v", got)
+
+	counts := make(map[string]int)
+	for i := 0; i < 7000; i++ {
+		s, _ := d.Get(WeightedRandomSelect)
+		counts[s]++
+	}
+	_assert(counts["a"] > counts["b"]*3 && counts["a"] > counts["c"]*3, "unexpected weighted random counts %v", counts)
+}
+
+func TestMultiServerDiscovery_ConsistentHash(t *testing.T) {
+	d := NewMultiServerDiscovery([]string{"a", "b", "c"})
+	before := make(map[string]string)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprint("key", i)
+		s, err := d.GetByKey(key)
+		_assert(err == nil && s != "", "failed to get server by key: %v", err)
+		s2, _ := d.GetByKey(key)
+		_assert(s == s2, "same key should map to the same server")
+		before[key] = s
+	}
+	_, err := d.Get(ConsistentHashSelect)
+	_assert(err != nil, "expect error when getting without a key")
+
+	// 移除一个实例后 只有原来属于该实例的key会改变
+	_ = d.Update([]string{"a", "b"})
+	for key, old := range before {
+		s, _ := d.GetByKey(key)
+		_assert(s != "c", "removed server should not be selected")
+		_assert(old == "c" || s == old, "key %s moved from %s to %s", key, old, s)
+	}
+}
+
+func TestXClient_ConsistentHash(t *testing.T) {
+	addr1, l1 := startServer(t)
+	defer l1.Close()
+	addr2, l2 := startServer(t)
+	defer l2.Close()
+	d := NewMultiServerDiscovery([]string{addr1, addr2})
+	xc := NewXClient(d, ConsistentHashSelect, nil)
+	xc.SetHashKeyFunc(func(serviceMethod string, args interface{}) string {
+		return fmt.Sprint(args.(*Args).Num1)
+	})
+	defer xc.Close()
+	for i := 0; i < 4; i++ {
+		var reply int
+		err := xc.Call(context.Background(), "Foo.Sum", &Args{Num1: i, Num2: 1}, &reply)
+		_assert(err == nil && reply == i+1, "failed to call Foo.Sum: %v", err)
+		want, _ := d.GetByKey(fmt.Sprint(i))
+		got, _ := xc.pick(xc.withHashKey(context.Background(), "Foo.Sum", &Args{Num1: i}), nil)
+		_assert(got == want, "expect %s, got %s", want, got)
+	}
+	var reply int
+	err := xc.Call(WithHashKey(context.Background(), "k"), "Foo.Sum", &Args{Num1: 1, Num2: 1}, &reply)
+	_assert(err == nil && reply == 2, "failed to call Foo.Sum with key in ctx: %v", err)
+}
+
+type fakeStats struct {
+	active  map[string]int
+	latency map[string]time.Duration
+}
+
+func (s fakeStats) Active(rpcAddr string) int            { return s.active[rpcAddr] }
+func (s fakeStats) Latency(rpcAddr string) time.Duration { return s.latency[rpcAddr] }
+
+func TestMultiServerDiscovery_Stats(t *testing.T) {
+	d := NewMultiServerDiscovery([]string{"a", "b", "c"})
+	stats := fakeStats{
+		active:  map[string]int{"a": 3, "b": 1, "c": 2},
+		latency: map[string]time.Duration{"a": time.Millisecond, "b": time.Millisecond * 100, "c": time.Millisecond * 10},
+	}
+	for i := 0; i < 10; i++ {
+		s, _ := d.GetByStats(LeastActiveSelect, stats)
+		_assert(s == "b", "expect least active server b, got %s", s)
+	}
+	counts := make(map[string]int)
+	for i := 0; i < 300; i++ {
+		s, _ := d.GetByStats(P2CSelect, stats)
+		counts[s]++
+	}
+	// 代价 a=4ms b=200ms c=30ms b只有在两个候选都是b时才会被选中 而候选不会重复
+	_assert(counts["b"] == 0 && counts["a"] > counts["c"], "unexpected p2c counts %v", counts)
+	_, err := d.Get(P2CSelect)
+	_assert(err != nil, "expect error when getting without stats")
+}
+
+func TestXClient_Stats(t *testing.T) {
+	addr, l := startServer(t)
+	defer l.Close()
+	xc := NewXClient(NewMultiServerDiscovery([]string{addr}), LeastActiveSelect, nil)
+	defer xc.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var reply int
+			_ = xc.Call(context.Background(), "Foo.Sleep", &Args{Num1: 100}, &reply)
+		}()
+	}
+	time.Sleep(time.Millisecond * 50)
+	_assert(xc.Stats().Active(addr) == 3, "expect 3 active requests, got %d", xc.Stats().Active(addr))
+	wg.Wait()
+	_assert(xc.Stats().Active(addr) == 0, "expect no active requests")
+	_assert(xc.Stats().Latency(addr) >= time.Millisecond*100, "unexpected latency %v", xc.Stats().Latency(addr))
+}
+
+func TestXClient_BroadcastVariants(t *testing.T) {
+	addr1, l1 := startServer(t)
+	defer l1.Close()
+	addr2, l2 := startServer(t)
+	defer l2.Close()
+	dead, dl := startServer(t)
+	_ = dl.Close()
+	xc := NewXClient(NewMultiServerDiscovery([]string{addr1, addr2, dead}), RandomSelect, &Option{Logger: NopLogger})
+	defer xc.Close()
+
+	var reply int
+	results, err := xc.BroadcastAll(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && len(results) == 3, "failed to broadcast: %v", err)
+	_assert(results[dead].Error != nil, "expect error from the dead server")
+	for _, addr := range []string{addr1, addr2} {
+		r := results[addr]
+		_assert(r.Error == nil && *r.Reply.(*int) == 3, "unexpected result from %s: %v", addr, r.Error)
+	}
+
+	_, err = xc.BroadcastQuorum(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply, 2)
+	_assert(err == nil, "expect quorum of 2 to be reached: %v", err)
+	results, err = xc.BroadcastQuorum(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply, 3)
+	_assert(err != nil && len(results) == 3, "expect quorum of 3 not to be reached")
+
+	start := time.Now()
+	err = xc.Fork(context.Background(), "Foo.Sleep", &Args{Num1: 50, Num2: 1}, &reply)
+	_assert(err == nil && reply == 51, "failed to fork: %v", err)
+	_assert(time.Since(start) < time.Second, "fork should return after the first success")
+
+	xc2 := NewXClient(NewMultiServerDiscovery([]string{dead}), RandomSelect, &Option{Logger: NopLogger})
+	defer xc2.Close()
+	err = xc2.Fork(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err != nil, "expect error when all servers fail")
+}
+
+// 对slow实例的调用结束后阻塞一段时间 模拟不响应取消的调用
+type slowDiscovery struct {
+	*MultiServerDiscovery
+	slow string
+}
+
+func (d *slowDiscovery) Report(rpcAddr string, err error) {
+	if rpcAddr == d.slow {
+		time.Sleep(time.Second)
+	}
+}
+
+func TestXClient_ScatterReturnsEarly(t *testing.T) {
+	addr1, l1 := startServer(t)
+	defer l1.Close()
+	addr2, l2 := startServer(t)
+	defer l2.Close()
+	d := &slowDiscovery{MultiServerDiscovery: NewMultiServerDiscovery([]string{addr1, addr2}), slow: addr2}
+	xc := NewXClient(d, RandomSelect, &Option{Logger: NopLogger})
+	defer xc.Close()
+
+	for i := 0; i < 3; i++ {
+		start := time.Now()
+		var reply int
+		err := xc.Fork(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+		_assert(err == nil && reply == 3, "failed to fork: %v", err)
+		results, err := xc.BroadcastQuorum(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply, 1)
+		_assert(err == nil && results[addr1].Error == nil && results[addr2].Error == context.Canceled, "unexpected quorum results %v", results)
+		_assert(time.Since(start) < time.Millisecond*500, "fork and quorum should not wait for the slow server")
+	}
+}
+
+func TestHealthCheckDiscovery(t *testing.T) {
+	addr, l := startServer(t)
+	defer l.Close()
+	dead, dl := startServer(t)
+	_ = dl.Close()
+
+	// 主动探测
+	hd := NewHealthCheckDiscovery(NewMultiServerDiscovery([]string{addr, dead}), &HealthOption{Interval: time.Hour, Logger: NopLogger})
+	defer hd.Close()
+	time.Sleep(time.Millisecond * 100) // 等待第一次探测
+	servers, _ := hd.GetAll()
+	_assert(fmt.Sprint(servers) == fmt.Sprint([]string{addr}), "expect only healthy server, got %v", servers)
+	states := hd.HealthStates()
+	_assert(states[addr] && !states[dead], "unexpected health states %v", states)
+
+	// 被动摘除
+	hd2 := NewHealthCheckDiscovery(NewMultiServerDiscovery([]string{addr, dead}), &HealthOption{ConsecutiveErrors: 2, Logger: NopLogger})
+	var mu sync.Mutex
+	var changes [][]string
+	cancel := hd2.OnChange(func(servers []string) {
+		mu.Lock()
+		changes = append(changes, servers)
+		mu.Unlock()
+	})
+	defer cancel()
+	xc := NewXClient(hd2, RoundRobinSelect, &Option{Logger: NopLogger})
+	defer xc.Close()
+	failed := 0
+	for i := 0; i < 8; i++ {
+		var reply int
+		if err := xc.Call(context.Background(), "Foo.Sum", &Args{Num1: i, Num2: 1}, &reply); err != nil {
+			failed++
+		}
+	}
+	_assert(failed == 2, "expect dead server to be ejected after 2 failures, got %d failures", failed)
+	// 订阅者收到的是所有实例 摘除不会让XClient清理该实例的状态
+	mu.Lock()
+	_assert(fmt.Sprint(changes) == fmt.Sprint([][]string{{addr, dead}}), "unexpected changes %v", changes)
+	mu.Unlock()
+
+	// 健康实例比例过低时返回所有实例
+	hd3 := NewHealthCheckDiscovery(NewMultiServerDiscovery([]string{addr, dead}), &HealthOption{ConsecutiveErrors: 1, PanicThreshold: 0.6, Logger: NopLogger})
+	hd3.Report(dead, ErrShutdown)
+	servers, _ = hd3.GetAll()
+	_assert(len(servers) == 2, "expect all servers in panic mode, got %v", servers)
+}
+
+func heartbeat(registryAddr, addr string) error {
+	req, _ := http.NewRequest("POST", registryAddr, nil)
+	req.Header.Set("X-Geerpc-Server", addr)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func TestGeeRegistryWatchDiscovery(t *testing.T) {
+	addr1, l1 := startServer(t)
+	defer l1.Close()
+	addr2, l2 := startServer(t)
+	defer l2.Close()
+	reg := registry.New(time.Millisecond * 300)
+	reg.SetLogger(nil)
+	ts := httptest.NewServer(reg)
+	defer ts.Close()
+	_assert(heartbeat(ts.URL, addr1) == nil && heartbeat(ts.URL, addr2) == nil, "failed to send heartbeats")
+
+	d := NewGeeRegistryWatchDiscovery(ts.URL, time.Second)
+	d.SetLogger(nil)
+	defer d.Close()
+	changes := make(chan []string, 10)
+	cancel := d.OnChange(func(servers []string) { changes <- servers })
+	defer cancel()
+	xc := NewXClient(d, RoundRobinSelect, &Option{Logger: NopLogger})
+	defer xc.Close()
+	for i := 0; i < 2; i++ {
+		var reply int
+		err := xc.Call(context.Background(), "Foo.Sum", &Args{Num1: i, Num2: 1}, &reply)
+		_assert(err == nil && reply == i+1, "failed to call Foo.Sum: %v", err)
+	}
+	_assert(len(<-changes) == 2, "expect 2 servers at first")
+
+	// 只有addr2继续发送心跳 addr1过期后长轮询立即返回
+	start := time.Now()
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	defer func() {
+		close(stop)
+		wg.Wait() // 关闭注册中心之前等待心跳结束
+	}()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Millisecond * 100):
+				if err := heartbeat(ts.URL, addr2); err != nil {
+					t.Error(err) // 不能在其他goroutine中调用t.Fatal
+					return
+				}
+			}
+		}
+	}()
+	select {
+	case servers := <-changes:
+		_assert(fmt.Sprint(servers) == fmt.Sprint([]string{addr2}), "unexpected servers %v", servers)
+	case <-time.After(time.Second * 2):
+		t.Fatal("expect watch to notice the expired server")
+	}
+	_assert(time.Since(start) < time.Second, "watch should return before wait timeout")
+	removed := false
+	for i := 0; i < 10 && !removed; i++ { // 订阅者按任意顺序被通知
+		xc.mu.Lock()
+		_, ok := xc.pools[addr1]
+		xc.mu.Unlock()
+		removed = !ok
+		time.Sleep(time.Millisecond * 10)
+	}
+	_assert(removed, "expect connections to the removed server to be closed")
+}
+
+func TestGeeRegistryDiscovery_Service(t *testing.T) {
+	reg := registry.New(0)
+	reg.SetLogger(nil)
+	ts := httptest.NewServer(reg)
+	defer ts.Close()
+
+	var foo Foo
+	server := NewServer()
+	server.SetLogger(nil)
+	_ = server.Register(&foo)
+	h := registry.HeartbeatWithOption(ts.URL, registry.ServerItem{Addr: "tcp@a"}, &registry.HeartbeatOption{Server: server, Duration: time.Hour, Logger: NopLogger})
+	defer h.Stop()
+	_assert(heartbeat(ts.URL, "tcp@b") == nil, "failed to send heartbeat") // 未上报服务
+	req, _ := http.NewRequest("POST", ts.URL+"?namespace=other", nil)
+	req.Header.Set("X-Geerpc-Server", "tcp@c")
+	req.Header.Set("X-Geerpc-Services", "Foo")
+	resp, err := http.DefaultClient.Do(req)
+	_assert(err == nil, "failed to register: %v", err)
+	_ = resp.Body.Close()
+
+	cases := []struct {
+		d    Discovery
+		want []string
+	}{
+		{NewGeeRegistryDiscoveryForService(ts.URL, "Foo", 0), []string{"tcp@a"}},
+		{NewGeeRegistryDiscoveryForService(ts.URL, "Bar", 0), []string{}},
+		{NewGeeRegistryDiscovery(ts.URL, 0), []string{"tcp@a", "tcp@b"}},
+		{NewGeeRegistryDiscoveryForService(ts.URL+"?namespace=other", "Foo", 0), []string{"tcp@c"}},
+	}
+	for _, c := range cases {
+		c.d.(*GeeRegistryDiscovery).SetLogger(nil)
+		servers, err := c.d.GetAll()
+		_assert(err == nil && fmt.Sprint(servers) == fmt.Sprint(c.want), "expect %v, got %v %v", c.want, servers, err)
+	}
+}
+
+func TestGeeRegistryDiscovery_Tags(t *testing.T) {
+	reg := registry.New(0)
+	reg.SetLogger(nil)
+	ts := httptest.NewServer(reg)
+	defer ts.Close()
+	quiet := &registry.HeartbeatOption{Duration: time.Hour, Logger: NopLogger}
+	ha := registry.HeartbeatWithOption(ts.URL, registry.ServerItem{Addr: "tcp@a", Version: "v2", Zone: "z1", Tags: []string{"canary", "ssd"}}, quiet)
+	defer ha.Stop()
+	hb := registry.HeartbeatWithOption(ts.URL, registry.ServerItem{Addr: "tcp@b", Version: "v1", Zone: "z1", Tags: []string{"ssd"}}, quiet)
+	defer hb.Stop()
+
+	d := NewGeeRegistryDiscovery(ts.URL, 0)
+	d.SetLogger(nil)
+	d.SetTags("canary")
+	servers, err := d.GetAll()
+	_assert(err == nil && fmt.Sprint(servers) == "[tcp@a]", "expect only canary server, got %v %v", servers, err)
+	item, ok := d.Instance("tcp@a")
+	_assert(ok && item.Version == "v2" && item.HasTag("canary"), "unexpected instance metadata %+v", item)
+
+	d2 := NewGeeRegistryWatchDiscovery(ts.URL, time.Second)
+	d2.SetLogger(nil)
+	d2.SetTags("ssd")
+	defer d2.Close()
+	servers, _ = d2.GetAll()
+	_assert(fmt.Sprint(servers) == "[tcp@a tcp@b]", "expect all ssd servers, got %v", servers)
+	_assert(len(d2.Instances()) == 2, "expect metadata of 2 instances")
+}
+
+func TestGeeRegistryDiscovery_Failover(t *testing.T) {
+	reg := registry.New(0)
+	reg.SetLogger(nil)
+	ts := httptest.NewServer(reg)
+	h := registry.HeartbeatWithOption(ts.URL, registry.ServerItem{Addr: "tcp@a"}, &registry.HeartbeatOption{Duration: time.Hour, Logger: NopLogger})
+	defer h.Stop()
+
+	dead := "http://127.0.0.1:1"
+	d := NewGeeRegistryDiscovery(dead+","+ts.URL, time.Millisecond)
+	d.SetLogger(nil)
+	servers, err := d.GetAll()
+	_assert(err == nil && fmt.Sprint(servers) == "[tcp@a]", "expect failover to live registry, got %v %v", servers, err)
+
+	d2 := NewGeeRegistryWatchDiscovery(dead+","+ts.URL, time.Second)
+	d2.SetLogger(nil)
+	defer d2.Close()
+	servers, err = d2.GetAll()
+	_assert(err == nil && fmt.Sprint(servers) == "[tcp@a]", "expect watch failover to live registry, got %v %v", servers, err)
+
+	ts.Close()
+	time.Sleep(time.Millisecond * 10)
+	_, err = d.GetAll()
+	_assert(err != nil, "expect error when all registries are down")
+}
+
+func TestGeeRegistryRPCDiscovery(t *testing.T) {
+	reg := registry.New(0)
+	reg.SetLogger(nil)
+	regServer := NewServer()
+	regServer.SetLogger(nil)
+	_ = regServer.Register(reg.Service())
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer l.Close()
+	go regServer.Accept(l)
+	regAddr := "tcp@" + l.Addr().String()
+
+	addr, sl := startServer(t)
+	defer sl.Close()
+	rc := registry.NewRegistryClient(regAddr, nil)
+	defer rc.Close()
+	h := rc.HeartbeatWithOption(registry.ServerItem{Addr: addr, Services: []string{"Foo"}, Tags: []string{"canary"}}, &registry.HeartbeatOption{Duration: time.Hour, Logger: NopLogger})
+
+	// 第一个注册中心无法连接时使用下一个
+	d := NewGeeRegistryRPCDiscovery("tcp@127.0.0.1:1,"+regAddr, registry.Query{Service: "Foo"}, time.Second, nil)
+	d.SetLogger(nil)
+	d.SetTags("canary")
+	defer d.Close()
+	xc := NewXClient(d, RoundRobinSelect, &Option{Logger: NopLogger})
+	defer xc.Close()
+	var reply int
+	err := xc.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 3, "failed to call through rpc discovery: %v", err)
+	item, ok := d.Instance(addr)
+	_assert(ok && item.HasTag("canary"), "unexpected instance metadata %+v", item)
+
+	result, err := rc.List(context.Background(), registry.Query{Service: "Bar"})
+	_assert(err == nil && len(result.Servers) == 0, "expect no server for Bar, got %+v %v", result, err)
+
+	// 注销后通过长轮询发现实例下线
+	_assert(h.Stop() == nil, "failed to deregister")
+	deadline := time.Now().Add(time.Second * 2)
+	for servers, _ := d.GetAll(); len(servers) > 0 && time.Now().Before(deadline); servers, _ = d.GetAll() {
+		time.Sleep(time.Millisecond * 10)
+	}
+	servers, _ := d.GetAll()
+	_assert(len(servers) == 0, "expect server to be removed, got %v", servers)
+}
+
+// 等待d中的实例数变为n
+func waitServers(d Discovery, n int) []string {
+	deadline := time.Now().Add(time.Second * 2)
+	servers, _ := d.GetAll()
+	for len(servers) != n && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+		servers, _ = d.GetAll()
+	}
+	return servers
+}
+
+func TestFileDiscovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "geerpc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "servers.json")
+	addr, l := startServer(t)
+	defer l.Close()
+	write := func(text string) {
+		if err := ioutil.WriteFile(path, []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(fmt.Sprintf(`{"servers": [{"addr": %q, "weight": 3, "tags": ["canary"]}, {"addr": "tcp@127.0.0.1:1"}]}`, addr))
+
+	_, err = NewFileDiscovery(filepath.Join(dir, "missing.json"), 0)
+	_assert(err != nil, "expect error for missing file")
+	d, err := NewFileDiscovery(path, time.Millisecond*10)
+	_assert(err == nil, "failed to load servers: %v", err)
+	d.SetLogger(nil)
+	defer d.Close()
+	servers, _ := d.GetAll()
+	_assert(len(servers) == 2, "expect 2 servers, got %v", servers)
+	_assert(d.Weights()[addr] == 3, "unexpected weights %v", d.Weights())
+	item, ok := d.Instance(addr)
+	_assert(ok && item.HasTag("canary"), "unexpected instance metadata %+v", item)
+
+	// 文件变化后重新读取 格式错误时保留之前的服务列表
+	write(fmt.Sprintf(`{"servers": [{"addr": %q}]}`, addr))
+	servers = waitServers(d, 1)
+	_assert(len(servers) == 1 && servers[0] == addr, "expect servers to be reloaded, got %v", servers)
+	write(`{"servers": [`)
+	time.Sleep(time.Millisecond * 50)
+	servers, _ = d.GetAll()
+	_assert(len(servers) == 1, "expect servers to be kept, got %v", servers)
+
+	write(fmt.Sprintf(`{"servers": [{"addr": %q, "tags": ["canary"]}, {"addr": "tcp@127.0.0.1:1"}]}`, addr))
+	_ = waitServers(d, 2)
+	d.SetTags("canary")
+	servers, _ = d.GetAll()
+	_assert(len(servers) == 1 && servers[0] == addr, "expect servers filtered by tag, got %v", servers)
+
+	xc := NewXClient(d, RoundRobinSelect, &Option{Logger: NopLogger})
+	defer xc.Close()
+	var reply int
+	err = xc.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 3, "failed to call through file discovery: %v", err)
+
+}
+
+// 返回固定结果的Resolver
+type fakeResolver struct {
+	mu    sync.Mutex
+	hosts map[string][]string
+	srvs  map[string][]*net.SRV
+}
+
+func (r *fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if addrs, ok := r.hosts[host]; ok {
+		return addrs, nil
+	}
+	return nil, errors.New("no such host")
+}
+
+func (r *fakeResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if addrs, ok := r.srvs[name]; ok {
+		return name, addrs, nil
+	}
+	return "", nil, errors.New("no such host")
+}
+
+func (r *fakeResolver) setHosts(host string, addrs ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.hosts[host] = addrs
+}
+
+func TestDNSDiscovery(t *testing.T) {
+	addr, l := startServer(t)
+	defer l.Close()
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+	resolver := &fakeResolver{
+		hosts: map[string][]string{"foo.local": {host}},
+		srvs: map[string][]*net.SRV{"_geerpc._tcp.foo.local": {
+			{Target: host + ".", Port: uint16(portNum), Priority: 10, Weight: 5},
+			{Target: "backup.local.", Port: 1, Priority: 20, Weight: 1},
+		}},
+	}
+	opt := &DNSOption{Resolver: resolver, Interval: time.Millisecond * 10}
+
+	_, err := NewDNSDiscovery("foo.local", opt)
+	_assert(err != nil, "expect error for missing port")
+	d, err := NewDNSDiscovery("foo.local:"+port, opt)
+	_assert(err == nil, "failed to create dns discovery: %v", err)
+	d.SetLogger(nil)
+	defer d.Close()
+	xc := NewXClient(d, RoundRobinSelect, &Option{Logger: NopLogger})
+	defer xc.Close()
+	var reply int
+	err = xc.Call(context.Background(), "Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 3, "failed to call through dns discovery: %v", err)
+
+	// 解析结果变化后更新 解析失败时保留之前的服务列表
+	resolver.setHosts("foo.local", host, "127.0.0.2")
+	servers := waitServers(d, 2)
+	_assert(len(servers) == 2 && servers[0] == addr, "expect servers to be updated, got %v", servers)
+	resolver.mu.Lock()
+	delete(resolver.hosts, "foo.local")
+	resolver.mu.Unlock()
+	time.Sleep(time.Millisecond * 50)
+	servers, _ = d.GetAll()
+	_assert(len(servers) == 2, "expect servers to be kept, got %v", servers)
+
+	// SRV记录只使用优先级最高的一组 Weight作为权重
+	srv, err := NewDNSSRVDiscovery("_geerpc._tcp.foo.local", opt)
+	_assert(err == nil, "failed to create srv discovery: %v", err)
+	srv.SetLogger(nil)
+	defer srv.Close()
+	servers, _ = srv.GetAll()
+	_assert(len(servers) == 1 && servers[0] == addr, "unexpected srv servers %v", servers)
+	_assert(srv.Weights()[addr] == 5, "unexpected srv weights %v", srv.Weights())
+}